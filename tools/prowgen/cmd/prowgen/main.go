@@ -21,9 +21,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	shell "github.com/kballard/go-shellquote"
@@ -43,6 +43,12 @@ var (
 	preprocessCommand   = flag.String("pre-process-command", "", "command to run to preprocess the meta config files")
 	postprocessCommand  = flag.String("post-process-command", "", "command to run to postprocess the generated config files")
 	longJobNamesAllowed = flag.Bool("allow-long-job-names", false, "allow job names that are longer than 63 characters")
+	strict              = flag.Bool("strict", false, "fail the generation on validation warnings")
+	checkCommands       = flag.Bool("check-commands", false, "require a command or args for the jobs, and args for the jobs running the entrypoint of their image")
+	localResources      = flag.Bool("local-resources", false, "require the jobs to reference the resources presets defined in their own file")
+	jsonnetCommand      = flag.String("jsonnet-command", "jsonnet", "command to evaluate the .jsonnet meta config files to JSON")
+	outputFormat        = flag.String("output-format", pkg.OutputFormatYAML, "format of the generated config files, yaml, json or ordered-yaml")
+	overlay             = flag.String("overlay", "", "named overlay to apply to the meta config files that define overlays, for print, write and check")
 )
 
 func main() {
@@ -58,6 +64,10 @@ func main() {
 	} else if len(flag.Args()) != 1 {
 		panic("too many arguments")
 	}
+	if *outputFormat != pkg.OutputFormatYAML && *outputFormat != pkg.OutputFormatJSON &&
+		*outputFormat != pkg.OutputFormatOrderedYAML {
+		panic("output-format must be one of yaml, json, ordered-yaml")
+	}
 
 	var bc spec.BaseConfig
 	if _, err := os.Stat(filepath.Join(*inputDir, ".base.yaml")); !os.IsNotExist(err) {
@@ -76,7 +86,8 @@ func main() {
 			if _, err := os.Stat(filepath.Join(path, ".base.yaml")); !os.IsNotExist(err) {
 				baseConfig = pkg.ReadBase(&baseConfig, filepath.Join(path, ".base.yaml"))
 			}
-			cli := pkg.Client{BaseConfig: baseConfig, LongJobNamesAllowed: *longJobNamesAllowed}
+			cli := pkg.Client{BaseConfig: baseConfig, LongJobNamesAllowed: *longJobNamesAllowed, Strict: *strict, CheckCommands: *checkCommands,
+				LocalResources: *localResources, JsonnetCommand: *jsonnetCommand}
 
 			files, _ := ioutil.ReadDir(path)
 			for _, file := range files {
@@ -84,8 +95,8 @@ func main() {
 					continue
 				}
 
-				if (filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml") ||
-					file.Name() == ".base.yaml" {
+				if (filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml" &&
+					filepath.Ext(file.Name()) != pkg.JsonnetExtension) || file.Name() == ".base.yaml" {
 					log.Println("skipping non-yaml file: ", file.Name())
 					continue
 				}
@@ -122,7 +133,12 @@ func main() {
 
 					name := file.Name()
 					ext := filepath.Ext(name)
-					name = name[:len(name)-len(ext)] + "-" + flag.Arg(1) + ext
+					name = name[:len(name)-len(ext)] + "-" + flag.Arg(1)
+					// The evaluated jsonnet files are written as YAML.
+					if ext == pkg.JsonnetExtension {
+						ext = ".yaml"
+					}
+					name += ext
 
 					dst := filepath.Join(*inputDir, name)
 					bytes, err := yaml.Marshal(jobs)
@@ -157,6 +173,8 @@ func main() {
 		// job configs before we generate the final config files.
 		// In this way we can have multiple meta-config files for the same org/repo:branch
 		cachedOutput := map[ref]k8sProwConfig.JobConfig{}
+		// Whether any of the meta config files defines the overlay.
+		overlayFound := false
 		if err := filepath.WalkDir(*inputDir, func(path string, d os.DirEntry, err error) error {
 			if !d.IsDir() {
 				return nil
@@ -169,7 +187,8 @@ func main() {
 			if _, err := os.Stat(filepath.Join(path, ".base.yaml")); !os.IsNotExist(err) {
 				baseConfig = pkg.ReadBase(&baseConfig, filepath.Join(path, ".base.yaml"))
 			}
-			cli := pkg.Client{BaseConfig: baseConfig, LongJobNamesAllowed: *longJobNamesAllowed}
+			cli := pkg.Client{BaseConfig: baseConfig, LongJobNamesAllowed: *longJobNamesAllowed, Strict: *strict, CheckCommands: *checkCommands,
+				LocalResources: *localResources, JsonnetCommand: *jsonnetCommand}
 
 			files, _ := ioutil.ReadDir(path)
 			for _, file := range files {
@@ -177,25 +196,37 @@ func main() {
 					continue
 				}
 
-				if (filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml") ||
-					file.Name() == ".base.yaml" {
+				if (filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml" &&
+					filepath.Ext(file.Name()) != pkg.JsonnetExtension) || file.Name() == ".base.yaml" {
 					log.Println("skipping non-yaml file: ", file.Name())
 					continue
 				}
 
 				src := filepath.Join(path, file.Name())
 				jobs := cli.ReadJobsConfig(src)
-				for _, branch := range jobs.Branches {
-					output, err := cli.ConvertJobConfig(file.Name(), jobs, branch)
-					if err != nil {
+				// The files without overlays are the same in all environments,
+				// but the files with overlays must define the selected one.
+				if *overlay != "" && len(jobs.Overlays) != 0 {
+					if jobs, err = pkg.ApplyOverlay(src, jobs, *overlay); err != nil {
 						log.Fatal(err)
 					}
+					overlayFound = true
+				}
+				outputs, err := cli.ConvertJobConfigForBranches(file.Name(), jobs)
+				if err != nil {
+					log.Fatal(err)
+				}
+				for _, branch := range jobs.Branches {
+					output := outputs[branch]
 					rf := ref{jobs.Org, jobs.Repo, branch}
 					if _, ok := cachedOutput[rf]; !ok {
 						cachedOutput[rf] = output
 					} else {
-						cachedOutput[rf] = combineJobConfigs(cachedOutput[rf], output,
-							fmt.Sprintf("%s/%s", jobs.Org, jobs.Repo))
+						merged, err := pkg.MergeJobConfigs(cachedOutput[rf], output)
+						if err != nil {
+							log.Fatalf("Failed to merge the jobs from %s: %v", src, err)
+						}
+						cachedOutput[rf] = merged
 					}
 				}
 			}
@@ -203,13 +234,24 @@ func main() {
 		}); err != nil {
 			log.Fatalf("Walking through the meta config files failed: %v", err)
 		}
+		if *overlay != "" && !overlayFound {
+			log.Fatalf("Unknown overlay %s, none of the meta config files define it", *overlay)
+		}
 
+		out := pkg.Client{BaseConfig: bc, OutputFormat: *outputFormat}
 		var err error
 		for r, output := range cachedOutput {
-			fname := outputFileName(r.repo, r.org, r.branch)
+			fname := pkg.OutputFileName(*outputDir, r.org, r.repo, r.branch)
+			if *outputFormat == pkg.OutputFormatJSON {
+				fname = strings.TrimSuffix(fname, filepath.Ext(fname)) + ".json"
+			}
+			if e := pkg.ValidateGeneratedConfig(output); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: %v", fname, e))
+				continue
+			}
 			switch flag.Arg(0) {
 			case "write":
-				if e := pkg.Write(output, fname, bc.AutogenHeader); e != nil {
+				if e := out.Write(output, fname, bc.AutogenHeader); e != nil {
 					err = multierror.Append(err, e)
 				}
 				if *postprocessCommand != "" {
@@ -218,11 +260,11 @@ func main() {
 					}
 				}
 			case "check":
-				if e := pkg.Check(output, fname, bc.AutogenHeader); e != nil {
+				if e := out.Check(output, fname, bc.AutogenHeader); e != nil {
 					err = multierror.Append(err, e)
 				}
 			case "print":
-				pkg.Print(output)
+				out.Print(output)
 			}
 		}
 
@@ -249,24 +291,3 @@ func runProcessCommand(rawCommand string) error {
 
 	return cmd.Run()
 }
-
-func outputFileName(repo string, org string, branch string) string {
-	key := fmt.Sprintf("%s.%s.%s.gen.yaml", org, repo, branch)
-	return path.Join(*outputDir, org, repo, key)
-}
-
-func combineJobConfigs(jc1, jc2 k8sProwConfig.JobConfig, orgRepo string) k8sProwConfig.JobConfig {
-	presubmits := jc1.PresubmitsStatic
-	postsubmits := jc1.PostsubmitsStatic
-	periodics := jc1.Periodics
-
-	presubmits[orgRepo] = append(presubmits[orgRepo], jc2.PresubmitsStatic[orgRepo]...)
-	postsubmits[orgRepo] = append(postsubmits[orgRepo], jc2.PostsubmitsStatic[orgRepo]...)
-	periodics = append(periodics, jc2.Periodics...)
-
-	return k8sProwConfig.JobConfig{
-		PresubmitsStatic:  presubmits,
-		PostsubmitsStatic: postsubmits,
-		Periodics:         periodics,
-	}
-}
@@ -25,8 +25,12 @@ const (
 	ModifierHidden            = "hidden"
 	ModifierPresubmitOptional = "presubmit_optional"
 	ModifierPresubmitSkipped  = "presubmit_skipped"
+	// ModifierSerial only allows one instance of the job to run at a time.
+	ModifierSerial = "serial"
 )
 
+// ApplyModifiersPresubmit applies the modifiers to the presubmit. A hidden job
+// is not reported, and is only shown by Deck instances that show hidden jobs.
 func ApplyModifiersPresubmit(presubmit *config.Presubmit, jobModifiers []string) {
 	for _, modifier := range jobModifiers {
 		switch modifier {
@@ -34,6 +38,7 @@ func ApplyModifiersPresubmit(presubmit *config.Presubmit, jobModifiers []string)
 			presubmit.Optional = true
 		case ModifierHidden:
 			presubmit.SkipReport = true
+			presubmit.Hidden = true
 			presubmit.ReporterConfig = &prowjob.ReporterConfig{
 				Slack: &prowjob.SlackReporterConfig{
 					JobStatesToReport: []prowjob.ProwJobState{},
@@ -41,6 +46,8 @@ func ApplyModifiersPresubmit(presubmit *config.Presubmit, jobModifiers []string)
 			}
 		case ModifierPresubmitSkipped:
 			presubmit.AlwaysRun = false
+		case ModifierSerial:
+			presubmit.MaxConcurrency = 1
 		default:
 			log.Fatalf("Modifier %q is not unsupported for %v", modifier, presubmit.Name)
 		}
@@ -52,8 +59,11 @@ func ApplyModifiersPostsubmit(postsubmit *config.Postsubmit, jobModifiers []stri
 		switch modifier {
 		case ModifierPresubmitOptional, ModifierPresubmitSkipped:
 			// No effect on postsubmit
+		case ModifierSerial:
+			postsubmit.MaxConcurrency = 1
 		case ModifierHidden:
 			postsubmit.SkipReport = true
+			postsubmit.Hidden = true
 			f := false
 			postsubmit.ReporterConfig = &prowjob.ReporterConfig{
 				Slack: &prowjob.SlackReporterConfig{
@@ -65,3 +75,24 @@ func ApplyModifiersPostsubmit(postsubmit *config.Postsubmit, jobModifiers []stri
 		}
 	}
 }
+
+func ApplyModifiersPeriodic(periodic *config.Periodic, jobModifiers []string) {
+	for _, modifier := range jobModifiers {
+		switch modifier {
+		case ModifierPresubmitOptional, ModifierPresubmitSkipped:
+			// No effect on periodic
+		case ModifierSerial:
+			periodic.MaxConcurrency = 1
+		case ModifierHidden:
+			periodic.Hidden = true
+			f := false
+			periodic.ReporterConfig = &prowjob.ReporterConfig{
+				Slack: &prowjob.SlackReporterConfig{
+					Report: &f,
+				},
+			}
+		default:
+			log.Fatalf("Modifier %q is not unsupported for %v", modifier, periodic.Name)
+		}
+	}
+}
@@ -54,18 +54,99 @@ func ApplyRequirements(baseConfig spec.BaseConfig, job *config.JobBase, requirem
 		log.Fatalf("Requirements validation failed: %v", err)
 	}
 
-	blocked := sets.NewString(excludedRequirements...)
 	presets := make([]spec.RequirementPreset, 0)
-	for _, req := range requirements {
-		if !blocked.Has(req) {
-			presets = append(presets, presetMap[req])
-		}
+	for _, req := range EffectiveRequirements(requirements, excludedRequirements) {
+		presets = append(presets, presetMap[req])
 	}
 	resolveRequirements(job.Annotations, job.Labels, job.Spec, presets)
 	applySecrets(job, presets)
+	applySidecars(job, presets)
+	applyToOtherContainers(job, presets)
 	applyAutoMaxProcs(baseConfig, job)
 }
 
+const (
+	// ContainersMain targets the container of the job with a preset.
+	ContainersMain = "main"
+	// ContainersAll targets all the containers of the job with a preset.
+	ContainersAll = "all"
+)
+
+// targetsContainer returns whether the env, args and volume mounts of the
+// preset apply to the container.
+func targetsContainer(req spec.RequirementPreset, name string, main bool) bool {
+	if len(req.Containers) == 0 {
+		return main
+	}
+	for _, c := range req.Containers {
+		if c == ContainersAll || (main && c == ContainersMain) || (!main && c == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyToOtherContainers applies the presets to the sidecars and init
+// containers they target. This is done once the sidecars are added, while the
+// main container is handled by resolveRequirements.
+func applyToOtherContainers(job *config.JobBase, presets []spec.RequirementPreset) {
+	if job.Spec == nil {
+		return
+	}
+	for _, req := range presets {
+		for i := 1; i < len(job.Spec.Containers); i++ {
+			if targetsContainer(req, job.Spec.Containers[i].Name, false) {
+				mergeContainerRequirement(&job.Spec.Containers[i], req)
+			}
+		}
+		for i := range job.Spec.InitContainers {
+			if targetsContainer(req, job.Spec.InitContainers[i].Name, false) {
+				mergeContainerRequirement(&job.Spec.InitContainers[i], req)
+			}
+		}
+	}
+}
+
+// EffectiveRequirements returns the names of the requirements that are applied
+// to a job, in the order they are applied.
+func EffectiveRequirements(requirements, excludedRequirements []string) []string {
+	blocked := sets.NewString(excludedRequirements...)
+	effective := make([]string, 0)
+	for _, req := range requirements {
+		if !blocked.Has(req) {
+			effective = append(effective, req)
+		}
+	}
+	return effective
+}
+
+// applySidecars appends the containers declared in the podSpec of the presets to
+// the job. This is done after the other fields of the presets are merged, so
+// the args, env and volume mounts of the presets only apply to the main
+// container. Containers with a name already in the job are skipped.
+func applySidecars(job *config.JobBase, presets []spec.RequirementPreset) {
+	if job.Spec == nil {
+		return
+	}
+	for _, req := range presets {
+		if req.PodSpec == nil {
+			continue
+		}
+		for _, c1 := range req.PodSpec.Containers {
+			exists := false
+			for _, c2 := range job.Spec.Containers {
+				if c2.Name == c1.Name {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				job.Spec.Containers = append(job.Spec.Containers, *c1.DeepCopy())
+			}
+		}
+	}
+}
+
 // With a big node and low CPU limit, go will spawn a thread per node core. This can lead to bad performance.
 func applyAutoMaxProcs(baseConfig spec.BaseConfig, job *config.JobBase) {
 	if !baseConfig.AutoMaxProcs {
@@ -119,21 +200,10 @@ func mergeRequirement(annotations, labels map[string]string, spec *v1.PodSpec, c
 	for l, v := range req.Labels {
 		labels[l] = v
 	}
+	// The containers of the job are only the main container at this point.
 	for i := range containers {
-		containers[i].Args = append(containers[i].Args, req.Args...)
-	}
-	for _, e1 := range req.Env {
-		for i := range containers {
-			exists := false
-			for _, e2 := range containers[i].Env {
-				if e2.Name == e1.Name {
-					exists = true
-					break
-				}
-			}
-			if !exists {
-				containers[i].Env = append(containers[i].Env, e1)
-			}
+		if targetsContainer(req, containers[i].Name, i == 0) {
+			mergeContainerRequirement(&containers[i], req)
 		}
 	}
 	for _, vl1 := range req.Volumes {
@@ -148,24 +218,46 @@ func mergeRequirement(annotations, labels map[string]string, spec *v1.PodSpec, c
 			*volumes = append(*volumes, vl1)
 		}
 	}
-	for _, vm1 := range req.VolumeMounts {
-		for i := range containers {
-			exists := false
-			for _, vm2 := range containers[i].VolumeMounts {
-				if vm2.MountPath == vm1.MountPath {
-					exists = true
-					break
-				}
-			}
-			if !exists {
-				containers[i].VolumeMounts = append(containers[i].VolumeMounts, vm1)
-			}
-		}
-	}
 
 	if req.PodSpec != nil {
-		if err := mergo.Merge(spec, req.PodSpec); err != nil {
+		// Containers are appended as sidecars by applySidecars.
+		podSpec := req.PodSpec.DeepCopy()
+		podSpec.Containers = nil
+		if err := mergo.Merge(spec, podSpec); err != nil {
 			log.Fatalf("Unable to merge PodSpec: %v", err)
 		}
 	}
 }
+
+// mergeContainerRequirement adds the args, env and volume mounts of the
+// requirement to the container, and sets its image pull policy if it has none.
+func mergeContainerRequirement(c *v1.Container, req spec.RequirementPreset) {
+	c.Args = append(c.Args, req.Args...)
+	if req.ImagePullPolicy != "" && c.ImagePullPolicy == "" {
+		c.ImagePullPolicy = req.ImagePullPolicy
+	}
+	for _, e1 := range req.Env {
+		exists := false
+		for _, e2 := range c.Env {
+			if e2.Name == e1.Name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			c.Env = append(c.Env, e1)
+		}
+	}
+	for _, vm1 := range req.VolumeMounts {
+		exists := false
+		for _, vm2 := range c.VolumeMounts {
+			if vm2.MountPath == vm1.MountPath {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			c.VolumeMounts = append(c.VolumeMounts, vm1)
+		}
+	}
+}
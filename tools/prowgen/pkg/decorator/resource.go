@@ -20,12 +20,16 @@ const (
 	defaultResource = "default"
 )
 
-func ApplyResource(c *v1.Container, jobResourceName string, presetMap map[string]v1.ResourceRequirements) {
+// ApplyResource sets the resources of the container to the named preset, or the
+// default preset if no name is given. It returns whether the preset exists.
+func ApplyResource(c *v1.Container, jobResourceName string, presetMap map[string]v1.ResourceRequirements) bool {
 	resourceName := defaultResource
 	if jobResourceName != "" {
 		resourceName = jobResourceName
 	}
 	if _, ok := presetMap[resourceName]; ok {
 		c.Resources = presetMap[resourceName]
+		return true
 	}
+	return false
 }
@@ -20,6 +20,10 @@ import (
 	"regexp"
 	"strings"
 
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/test-infra/prow/config"
 	"sigs.k8s.io/yaml"
 
 	"istio.io/test-infra/tools/prowgen/pkg/spec"
@@ -28,26 +32,42 @@ import (
 const (
 	matrixPrefix = "matrix."
 	paramsPrefix = "params."
+	jobPrefix    = "job."
+
+	archLabel = "kubernetes.io/arch"
 )
 
+// JobMetadataKeys are the keys of the job metadata that can be referenced as
+// $(job.key) in the labels, annotations and env values of the jobs.
+var JobMetadataKeys = sets.NewString("name", "repo", "org", "branch")
+
 var variableSubstitutionRegex = regexp.MustCompile(`\$\([_a-zA-Z0-9.-]+(\.[_a-zA-Z0-9.-]+)*\)`)
 
-func applyArch(arch string, job spec.Job, clusterOverrides map[string]string) spec.Job {
-	// For backwards compatibility, amd64 is not suffixed
-	if arch != "amd64" {
+// applyArch schedules the job to the nodes of the arch. If pinnable, i.e. the
+// job does not set its architectures, an arch pinned by its node selector is
+// used instead.
+func applyArch(arch string, job spec.Job, clusterOverrides map[string]string, pinnable bool) spec.Job {
+	if pinned := job.NodeSelector[archLabel]; pinnable && pinned != "" {
+		// The arch is pinned by the node selector of the job, e.g. with
+		// $(matrix.arch), so the matrix already makes the name unique.
+		arch = pinned
+	} else if arch != "amd64" {
+		// For backwards compatibility, amd64 is not suffixed
 		job.Name += "-" + arch
 	}
 
 	if job.NodeSelector == nil {
 		job.NodeSelector = map[string]string{}
 	}
-	job.NodeSelector["kubernetes.io/arch"] = arch
+	job.NodeSelector[archLabel] = arch
 	if c, f := clusterOverrides[arch]; f {
 		job.Cluster = c
 	}
 	return job
 }
 
+// ApplyVariables expands the job into the jobs for each of the architectures,
+// which default to amd64, and each combination of the matrix it references.
 func ApplyVariables(
 	job spec.Job,
 	architectures []string,
@@ -62,10 +82,16 @@ func ApplyVariables(
 
 	jobs := make([]spec.Job, 0)
 
+	// The explicit architectures of the job take precedence over an arch
+	// pinned by the node selector, since each of them must generate a job.
+	pinnable := len(architectures) == 0
+	if pinnable {
+		architectures = []string{"amd64"}
+	}
 	for _, arch := range architectures {
 		subsExps := getVarSubstitutionExpressions(string(yamlBS))
 		if len(subsExps) == 0 && len(architectures) == 1 {
-			jobs = append(jobs, applyArch(arch, job, overrides))
+			jobs = append(jobs, applyArch(arch, job, overrides, pinnable))
 			continue
 		}
 		if params == nil {
@@ -74,14 +100,17 @@ func ApplyVariables(
 		params["arch"] = arch
 
 		resolvedYAMLStr := applyParams(string(yamlBS), subsExps, params)
-		resolvedYAMLStrs := applyMatrix(resolvedYAMLStr, subsExps, matrix)
+		combinations := applyMatrix(resolvedYAMLStr, subsExps, matrix)
 
-		for _, jobYaml := range resolvedYAMLStrs {
+		for _, comb := range combinations {
 			job := spec.Job{}
-			if err := yaml.Unmarshal([]byte(jobYaml), &job); err != nil {
+			if err := yaml.Unmarshal([]byte(comb.yaml), &job); err != nil {
 				log.Fatalf("Failed to unmarshal the yaml to Job: %v", err)
 			}
-			jobs = append(jobs, applyArch(arch, job, overrides))
+			if job.MatrixLabels {
+				applyMatrixLabels(&job, comb.values)
+			}
+			jobs = append(jobs, applyArch(arch, job, overrides, pinnable))
 		}
 	}
 	return jobs
@@ -103,9 +132,16 @@ func applyParams(yamlStr string, subsExps []string, params map[string]string) st
 	return yamlStr
 }
 
+// matrixCombination is the YAML of a job resolved for a combination of the
+// matrix, with the value chosen for each dimension.
+type matrixCombination struct {
+	yaml   string
+	values map[string]string
+}
+
 // applyMatrix will resolve all the $(matrix.dimension) expressions into the
 // configured lists of values, and then calculate all the combinations.
-func applyMatrix(yamlStr string, subsExps []string, matrix map[string][]string) []string {
+func applyMatrix(yamlStr string, subsExps []string, matrix map[string][]string) []matrixCombination {
 	combs := make([]string, 0)
 	for _, exp := range subsExps {
 		if strings.HasPrefix(exp, matrixPrefix) {
@@ -118,22 +154,157 @@ func applyMatrix(yamlStr string, subsExps []string, matrix map[string][]string)
 		}
 	}
 
-	res := &[]string{}
-	resolveCombinations(combs, yamlStr, 0, matrix, res)
+	res := &[]matrixCombination{}
+	resolveCombinations(combs, yamlStr, 0, matrix, map[string]string{}, res)
+	if err := checkExpanded(*res, combs, matrix); err != nil {
+		log.Fatalf("Failed to resolve the matrix: %v", err)
+	}
 	return *res
 }
 
-func resolveCombinations(combs []string, dest string, start int, matrix map[string][]string, res *[]string) {
+// applyMatrixLabels labels the job with the value chosen for each dimension of
+// the matrix, keyed by the dimension. The labels of the job are not overridden.
+func applyMatrixLabels(job *spec.Job, values map[string]string) {
+	if len(values) != 0 && job.Labels == nil {
+		job.Labels = map[string]string{}
+	}
+	for dim, val := range values {
+		if _, ok := job.Labels[dim]; !ok {
+			job.Labels[dim] = sanitizeLabelValue(val)
+		}
+	}
+}
+
+var invalidLabelValueChars = regexp.MustCompile(`[^-_.a-zA-Z0-9]`)
+
+// sanitizeLabelValue returns the value as a valid label value, which is at
+// most 63 characters of alphanumerics, '-', '_' or '.', beginning and ending
+// with an alphanumeric.
+func sanitizeLabelValue(value string) string {
+	value = invalidLabelValueChars.ReplaceAllString(value, "-")
+	if len(value) > validation.LabelValueMaxLength {
+		value = value[:validation.LabelValueMaxLength]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// CheckMatrixExpansion returns an error if resolving the matrix for the job
+// leaves any $(matrix.dimension) expressions unexpanded, e.g. because the
+// value of a dimension references another dimension.
+func CheckMatrixExpansion(job spec.Job, matrix map[string][]string) error {
+	yamlBS, err := yaml.Marshal(job)
+	if err != nil {
+		return err
+	}
+	var combs []string
+	for _, exp := range getVarSubstitutionExpressions(string(yamlBS)) {
+		if strings.HasPrefix(exp, matrixPrefix) {
+			if _, ok := matrix[strings.TrimPrefix(exp, matrixPrefix)]; ok {
+				combs = append(combs, strings.TrimPrefix(exp, matrixPrefix))
+			}
+		}
+	}
+	res := &[]matrixCombination{}
+	resolveCombinations(combs, string(yamlBS), 0, matrix, map[string]string{}, res)
+	return checkExpanded(*res, combs, matrix)
+}
+
+// checkExpanded scans the resolved YAMLs for the $(matrix.dimension)
+// expressions that are left, and returns an error naming the dimension whose
+// value introduced them.
+func checkExpanded(combinations []matrixCombination, combs []string, matrix map[string][]string) error {
+	for _, comb := range combinations {
+		for _, exp := range getVarSubstitutionExpressions(comb.yaml) {
+			if !strings.HasPrefix(exp, matrixPrefix) {
+				continue
+			}
+			ref := fmt.Sprintf("$(%s)", exp)
+			for _, dim := range combs {
+				for _, val := range matrix[dim] {
+					if strings.Contains(val, ref) {
+						return fmt.Errorf("%s is left unexpanded, it is referenced by the value %q of dimension %q", ref, val, dim)
+					}
+				}
+			}
+			return fmt.Errorf("%s is left unexpanded", ref)
+		}
+	}
+	return nil
+}
+
+func resolveCombinations(combs []string, dest string, start int, matrix map[string][]string, chosen map[string]string,
+	res *[]matrixCombination) {
 	if start == len(combs) {
-		*res = append(*res, dest)
+		values := make(map[string]string, len(chosen))
+		for dim, val := range chosen {
+			values[dim] = val
+		}
+		*res = append(*res, matrixCombination{yaml: dest, values: values})
 		return
 	}
 
 	lst := matrix[combs[start]]
 	for i := range lst {
 		dest := replace(dest, matrixPrefix, combs[start], lst[i])
-		resolveCombinations(combs, dest, start+1, matrix, res)
+		chosen[combs[start]] = lst[i]
+		resolveCombinations(combs, dest, start+1, matrix, chosen, res)
+	}
+	delete(chosen, combs[start])
+}
+
+// ApplyJobMetadata resolves the $(job.key) expressions in the labels,
+// annotations and env values of the job into the job metadata.
+func ApplyJobMetadata(job *config.JobBase, metadata map[string]string) {
+	resolve := func(value string) string {
+		for _, exp := range getVarSubstitutionExpressions(value) {
+			if strings.HasPrefix(exp, jobPrefix) {
+				key := strings.TrimPrefix(exp, jobPrefix)
+				if val, ok := metadata[key]; ok {
+					value = replace(value, jobPrefix, key, val)
+				}
+			}
+		}
+		return value
+	}
+	for k, v := range job.Labels {
+		job.Labels[k] = resolve(v)
+	}
+	for k, v := range job.Annotations {
+		job.Annotations[k] = resolve(v)
+	}
+	if job.Spec == nil {
+		return
+	}
+	for i := range job.Spec.Containers {
+		c := &job.Spec.Containers[i]
+		for j := range c.Env {
+			c.Env[j].Value = resolve(c.Env[j].Value)
+		}
+	}
+}
+
+// UnknownJobMetadata returns the keys of the $(job.key) expressions in the
+// labels, annotations and env values that are not job metadata.
+func UnknownJobMetadata(labels, annotations map[string]string, env []v1.EnvVar) []string {
+	values := make([]string, 0, len(labels)+len(annotations)+len(env))
+	for _, v := range labels {
+		values = append(values, v)
+	}
+	for _, v := range annotations {
+		values = append(values, v)
+	}
+	for _, e := range env {
+		values = append(values, e.Value)
+	}
+	unknown := sets.NewString()
+	for _, value := range values {
+		for _, exp := range getVarSubstitutionExpressions(value) {
+			if key := strings.TrimPrefix(exp, jobPrefix); key != exp && !JobMetadataKeys.Has(key) {
+				unknown.Insert(key)
+			}
+		}
 	}
+	return unknown.List()
 }
 
 // replace replaces the expressions written as $(prefix.expKey) with the expVal
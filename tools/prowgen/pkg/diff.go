@@ -0,0 +1,286 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/test-infra/prow/config"
+
+	"istio.io/test-infra/tools/prowgen/pkg/spec"
+)
+
+// FieldChange is a field of a job that differs between two configs. Old or
+// New is nil if the field is only set in one of them.
+type FieldChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// JobDiff is a job that differs between two configs, with the changes of its
+// fields. The field of the change is empty for a job that was added or removed.
+type JobDiff struct {
+	Type    string
+	Name    string
+	Changes []FieldChange
+}
+
+// String formats the diff for humans, with one line per changed field.
+func (d JobDiff) String() string {
+	lines := []string{fmt.Sprintf("%s %s:", d.Type, d.Name)}
+	for _, c := range d.Changes {
+		field := c.Field
+		if field == "" {
+			field = "<job>"
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s -> %s", field, formatValue(c.Old), formatValue(c.New)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FormatJobDiffs formats the diffs for humans, one job after the other.
+func FormatJobDiffs(diffs []JobDiff) string {
+	lines := make([]string, 0, len(diffs))
+	for _, d := range diffs {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ComputeDiff compares the jobs of the two configs by type and name, and returns
+// the fields changed in each job that differs, ordered by type and name.
+func ComputeDiff(old, new config.JobConfig) ([]JobDiff, error) {
+	oldJobs, err := jobsByTypeAndName(old)
+	if err != nil {
+		return nil, err
+	}
+	newJobs, err := jobsByTypeAndName(new)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []JobDiff
+	for _, jobType := range []string{TypePresubmit, TypePostsubmit, TypePeriodic} {
+		for _, d := range diffByName(oldJobs[jobType], newJobs[jobType]) {
+			diffs = append(diffs, JobDiff{Type: jobType, Name: d.name, Changes: d.changes})
+		}
+	}
+	return diffs, nil
+}
+
+// namedChanges are the changes of the value with the name.
+type namedChanges struct {
+	name    string
+	changes []FieldChange
+}
+
+// diffByName compares the generic JSON values with the same name, and returns
+// the changes of the names that differ, ordered by name. A value with a name
+// only in old or new is reported as a single change without a field.
+func diffByName(old, new map[string]interface{}) []namedChanges {
+	var res []namedChanges
+	for _, name := range sets.StringKeySet(old).Union(sets.StringKeySet(new)).List() {
+		var changes []FieldChange
+		diffValues("", old[name], new[name], &changes)
+		if len(changes) != 0 {
+			res = append(res, namedChanges{name: name, changes: changes})
+		}
+	}
+	return res
+}
+
+// SourceDiff is the difference between two meta configs of a file, before they
+// are converted to Prow jobs.
+type SourceDiff struct {
+	// Changes are the changed fields of the file, other than its jobs.
+	Changes []FieldChange
+	// Added and Removed are the names of the jobs only in the new or old config.
+	Added   []string
+	Removed []string
+	// Modified are the jobs in both configs whose fields changed.
+	Modified []SourceJobDiff
+}
+
+// SourceJobDiff is a job of a meta config whose fields changed.
+type SourceJobDiff struct {
+	Name    string
+	Changes []FieldChange
+}
+
+// DiffJobsConfig compares the two meta configs of a file, and returns the
+// changed fields of the file, and the jobs added, removed or modified by name,
+// ordered by name. The changes the jobs inherit from the file are also listed
+// for each job if the configs were read with ReadJobsConfig.
+func DiffJobsConfig(old, new spec.JobsConfig) (SourceDiff, error) {
+	var diff SourceDiff
+	oldFile, newFile := old, new
+	oldFile.Jobs, newFile.Jobs = nil, nil
+	o, err := toGenericValue(oldFile)
+	if err != nil {
+		return diff, err
+	}
+	n, err := toGenericValue(newFile)
+	if err != nil {
+		return diff, err
+	}
+	diffValues("", o, n, &diff.Changes)
+
+	oldJobs, err := metaJobsByName(old.Jobs)
+	if err != nil {
+		return diff, err
+	}
+	newJobs, err := metaJobsByName(new.Jobs)
+	if err != nil {
+		return diff, err
+	}
+	for _, d := range diffByName(oldJobs, newJobs) {
+		switch {
+		case oldJobs[d.name] == nil:
+			diff.Added = append(diff.Added, d.name)
+		case newJobs[d.name] == nil:
+			diff.Removed = append(diff.Removed, d.name)
+		default:
+			diff.Modified = append(diff.Modified, SourceJobDiff{Name: d.name, Changes: d.changes})
+		}
+	}
+	return diff, nil
+}
+
+// metaJobsByName returns the jobs of a meta config as generic JSON values,
+// keyed by their name.
+func metaJobsByName(jobs []spec.Job) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+	for _, job := range jobs {
+		v, err := toGenericValue(job)
+		if err != nil {
+			return nil, err
+		}
+		res[job.Name] = v
+	}
+	return res, nil
+}
+
+// toGenericValue converts the value to a generic JSON value.
+func toGenericValue(value interface{}) (interface{}, error) {
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// jobsByTypeAndName returns the jobs of the config as generic JSON values,
+// keyed by their type and name.
+func jobsByTypeAndName(jobs config.JobConfig) (map[string]map[string]interface{}, error) {
+	res := map[string]map[string]interface{}{TypePresubmit: {}, TypePostsubmit: {}, TypePeriodic: {}}
+	add := func(jobType, name string, job interface{}) error {
+		v, err := toGenericValue(job)
+		if err != nil {
+			return err
+		}
+		res[jobType][name] = v
+		return nil
+	}
+	for _, presubmits := range jobs.PresubmitsStatic {
+		for _, p := range presubmits {
+			if err := add(TypePresubmit, p.Name, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, postsubmits := range jobs.PostsubmitsStatic {
+		for _, p := range postsubmits {
+			if err := add(TypePostsubmit, p.Name, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, p := range jobs.Periodics {
+		if err := add(TypePeriodic, p.Name, p); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// diffValues appends the changes between the generic JSON values at the path.
+func diffValues(path string, old, new interface{}, changes *[]FieldChange) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := map[string]bool{}
+		for k := range oldMap {
+			keys[k] = true
+		}
+		for k := range newMap {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			field := k
+			if path != "" {
+				field = path + "." + k
+			}
+			diffValues(field, oldMap[k], newMap[k], changes)
+		}
+		return
+	}
+
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList {
+		for i := 0; i < len(oldList) || i < len(newList); i++ {
+			var o, n interface{}
+			if i < len(oldList) {
+				o = oldList[i]
+			}
+			if i < len(newList) {
+				n = newList[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), o, n, changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, FieldChange{Field: path, Old: old, New: new})
+	}
+}
+
+// formatValue formats a generic JSON value of a change as JSON.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "<unset>"
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(bs)
+}
@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestComputeDiff(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	meta := `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [%s, test]
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+`
+	old, err := cli.ConvertJobConfig("jobs.yaml", readJobsConfig(t, cli, fmt.Sprintf(meta, "make")), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := cli.ConvertJobConfig("jobs.yaml", readJobsConfig(t, cli, fmt.Sprintf(meta, "go")), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := ComputeDiff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JobDiff{{
+		Type: TypePresubmit,
+		Name: "unit_istio",
+		Changes: []FieldChange{{
+			Field: "spec.containers[0].command[0]",
+			Old:   "make",
+			New:   "go",
+		}},
+	}}
+	if diff := cmp.Diff(want, diffs); diff != "" {
+		t.Fatalf("diffs do not match, (-want, +got): \n%s", diff)
+	}
+	wantString := "presubmit unit_istio:\n  spec.containers[0].command[0]: \"make\" -> \"go\""
+	if got := diffs[0].String(); got != wantString {
+		t.Errorf("expected the diff to be printed as %q, got %q", wantString, got)
+	}
+
+	// A removed job is reported as a single change of the whole job.
+	new.PresubmitsStatic["istio/istio"] = new.PresubmitsStatic["istio/istio"][:1]
+	diffs, err = ComputeDiff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 || diffs[0].Name != "lint_istio" || diffs[0].Changes[0].Field != "" || diffs[0].Changes[0].New != nil {
+		t.Errorf("expected lint_istio to be reported as removed, got %v", diffs)
+	}
+}
+
+func TestDiffJobsConfig(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	old := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  version: ["1.24"]
+jobs:
+- name: unit
+  command: [make, test]
+- name: lint
+  command: [make, lint]
+`)
+	new := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  version: ["1.24", "1.25"]
+jobs:
+- name: unit
+  command: [make, test]
+  requirements: [kind]
+- name: e2e
+  command: [make, e2e]
+`)
+	diff, err := DiffJobsConfig(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SourceDiff{
+		Changes: []FieldChange{{Field: "matrix.version[1]", New: "1.25"}},
+		Added:   []string{"e2e"},
+		Removed: []string{"lint"},
+		// The jobs read with ReadJobsConfig also inherit the changes of the file.
+		Modified: []SourceJobDiff{{
+			Name: "unit",
+			Changes: []FieldChange{
+				{Field: "matrix.version[1]", New: "1.25"},
+				{Field: "requirements[1]", New: "kind"},
+			},
+		}},
+	}
+	if d := cmp.Diff(want, diff); d != "" {
+		t.Fatalf("source diffs do not match, (-want, +got): \n%s", d)
+	}
+}
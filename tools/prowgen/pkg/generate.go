@@ -15,16 +15,23 @@
 package pkg
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/imdario/mergo"
-	"gopkg.in/robfig/cron.v2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
@@ -40,8 +47,31 @@ const (
 	TestGridDashboard   = "testgrid-dashboards"
 	TestGridAlertEmail  = "testgrid-alert-email"
 	TestGridNumFailures = "testgrid-num-failures-to-alert"
+	TestGridCreateGroup = "testgrid-create-test-group"
+	// TestGridDashboardGroup is the annotation recording the testgrid dashboard
+	// group of the dashboards of the job. The testgrid configurator does not
+	// read it, so it is meant for the tooling that generates the dashboard
+	// groups.
+	TestGridDashboardGroup = "prowgen.istio.io/testgrid-dashboard-group"
 
 	DefaultAutogenHeader = "# THIS FILE IS AUTOGENERATED, DO NOT EDIT IT MANUALLY."
+	// NoAutogenHeader can be set as the autogen header to not add any header.
+	NoAutogenHeader = "none"
+
+	// TriggerLabelAnnotation is the annotation recording the PR label that
+	// should trigger the presubmit.
+	TriggerLabelAnnotation = "prowgen.istio.io/trigger-label"
+
+	// DefaultCluster is the cluster Prow schedules the jobs to by default.
+	DefaultCluster = "default"
+
+	// JsonnetExtension is the extension of the meta config files that are
+	// evaluated with the JsonnetCommand of the client.
+	JsonnetExtension = ".jsonnet"
+
+	OutputFormatYAML        = "yaml"
+	OutputFormatJSON        = "json"
+	OutputFormatOrderedYAML = "ordered-yaml"
 
 	ArchAMD64 = "amd64"
 	ArchARM64 = "arm64"
@@ -58,43 +88,191 @@ type Client struct {
 	BaseConfig spec.BaseConfig
 
 	LongJobNamesAllowed bool
+	// Strict makes the validation warnings fail the generation.
+	Strict bool
+	// CheckCommands makes the validation require a command or args for the
+	// jobs, and args for the jobs that run the entrypoint of their image, i.e.
+	// one of the EntrypointImages of the base config or use_image_entrypoint.
+	CheckCommands bool
+	// LocalResources makes the validation require the jobs to reference the
+	// resources presets defined in their own file, so that a typo in the name
+	// of a file preset does not silently fall back to a base preset.
+	LocalResources bool
+	// OutputFormat is the format of the generated config, one of
+	// OutputFormatYAML, OutputFormatJSON or OutputFormatOrderedYAML. Defaults
+	// to YAML.
+	OutputFormat string
+	// JsonnetCommand is the command that evaluates the .jsonnet meta config
+	// files to JSON, with the path of the file as its last argument. Defaults
+	// to jsonnet.
+	JsonnetCommand string
+	// CacheReads makes Check and VerifyConfig read each current config file
+	// only once, until it is written or invalidated with InvalidateFile.
+	CacheReads bool
+
+	mu    sync.Mutex
+	files map[string][]byte
+	// warned are the warnings already logged.
+	warned sets.String
 }
 
 func ReadBase(baseConfig *spec.BaseConfig, file string) spec.BaseConfig {
-	yamlFile, err := ioutil.ReadFile(file)
+	newBaseConfig, err := readBase(baseConfig, file, ioutil.ReadFile)
 	if err != nil {
-		log.Fatalf("Failed to read %q: %v", file, err)
+		log.Fatal(err)
+	}
+	return newBaseConfig
+}
+
+// ReadBaseFS reads the base config like ReadBase, but from the file system,
+// e.g. an embed.FS of bundled configs.
+func ReadBaseFS(fsys fs.FS, baseConfig *spec.BaseConfig, name string) (spec.BaseConfig, error) {
+	return readBase(baseConfig, name, func(name string) ([]byte, error) {
+		return fs.ReadFile(fsys, name)
+	})
+}
+
+func readBase(baseConfig *spec.BaseConfig, file string, readFile func(string) ([]byte, error)) (spec.BaseConfig, error) {
+	yamlFile, err := readFile(file)
+	if err != nil {
+		return spec.BaseConfig{}, fmt.Errorf("failed to read %q: %v", file, err)
 	}
 	newBaseConfig := spec.BaseConfig{}
 	if err := yaml.UnmarshalStrict(yamlFile, &newBaseConfig, yaml.DisallowUnknownFields); err != nil {
-		log.Fatalf("Failed to unmarshal %q: %v", file, err)
+		return spec.BaseConfig{}, fmt.Errorf("failed to unmarshal %q: %v", file, err)
 	}
 	if baseConfig == nil {
-		return newBaseConfig
+		return newBaseConfig, nil
 	}
 
 	mergedBaseConfig := baseConfig.DeepCopy()
-	mergedBaseConfig.CommonConfig = mergeCommonConfig(mergedBaseConfig.CommonConfig, newBaseConfig.CommonConfig)
+	mergedBaseConfig.CommonConfig = mergeCommonConfig(mergedBaseConfig.MergeResourcePresets,
+		mergedBaseConfig.CommonConfig, newBaseConfig.CommonConfig)
 
-	return mergedBaseConfig
+	return mergedBaseConfig, nil
 }
 
-// Reads the jobs yaml
+// Reads the jobs yaml. Files with the JsonnetExtension are evaluated with the
+// JsonnetCommand first.
 func (cli *Client) ReadJobsConfig(file string) spec.JobsConfig {
-	yamlFile, err := ioutil.ReadFile(file)
+	jobsConfig, err := cli.readJobsConfigFile(file)
 	if err != nil {
-		log.Fatalf("Failed to read %q: %v", file, err)
+		log.Fatal(err)
+	}
+	return jobsConfig
+}
+
+// readJobsConfigFile reads the jobs config like ReadJobsConfig, but returns
+// the error instead of exiting.
+func (cli *Client) readJobsConfigFile(file string) (spec.JobsConfig, error) {
+	return cli.readJobsConfig(file, cli.readMetaFile, func(envFile string) string {
+		if filepath.IsAbs(envFile) {
+			return envFile
+		}
+		return filepath.Join(filepath.Dir(file), envFile)
+	})
+}
+
+// ReadJobsConfigFS reads the jobs config like ReadJobsConfig, but from the file
+// system, e.g. an embed.FS of bundled configs. The env file is read from the
+// same file system, relative to the jobs config.
+func (cli *Client) ReadJobsConfigFS(fsys fs.FS, name string) (spec.JobsConfig, error) {
+	if path.Ext(name) == JsonnetExtension {
+		return spec.JobsConfig{}, fmt.Errorf("failed to read %q: jsonnet files can only be read from disk", name)
+	}
+	return cli.readJobsConfig(name, func(name string) ([]byte, error) {
+		return fs.ReadFile(fsys, name)
+	}, func(envFile string) string {
+		return path.Join(path.Dir(name), envFile)
+	})
+}
+
+// readMetaFile reads the file, or evaluates it to JSON if it is a jsonnet file.
+func (cli *Client) readMetaFile(name string) ([]byte, error) {
+	if filepath.Ext(name) != JsonnetExtension {
+		return ioutil.ReadFile(name)
+	}
+	command := strings.Fields(cli.JsonnetCommand)
+	if len(command) == 0 {
+		command = []string{"jsonnet"}
+	}
+	out, err := exec.Command(command[0], append(command[1:], name)...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) != 0 {
+			return nil, fmt.Errorf("failed to evaluate %s with %s: %v: %s", name, command[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("failed to evaluate %s: %v, jsonnet must be installed to read jsonnet files", name, err)
+		}
+		return nil, fmt.Errorf("failed to evaluate %s with %s: %v", name, command[0], err)
+	}
+	return out, nil
+}
+
+// readJobsConfig reads the jobs config with readFile, and resolves the path of
+// its env file with envFilePath.
+func (cli *Client) readJobsConfig(file string, readFile func(string) ([]byte, error),
+	envFilePath func(string) string) (spec.JobsConfig, error) {
+	yamlFile, err := readFile(file)
+	if err != nil {
+		return spec.JobsConfig{}, fmt.Errorf("failed to read %q: %v", file, err)
 	}
 	jobsConfig := spec.JobsConfig{}
 	if err := yaml.UnmarshalStrict(yamlFile, &jobsConfig); err != nil {
-		log.Fatalf("Failed to unmarshal %q: %v", file, err)
+		return spec.JobsConfig{}, fmt.Errorf("failed to unmarshal %q: %v", file, err)
+	}
+
+	if jobsConfig.EnvFile != "" {
+		envFile := envFilePath(jobsConfig.EnvFile)
+		bs, err := readFile(envFile)
+		if err != nil {
+			return spec.JobsConfig{}, fmt.Errorf("failed to read env file for %q: %v", file, err)
+		}
+		envs, err := parseEnvFile(envFile, bs)
+		if err != nil {
+			return spec.JobsConfig{}, fmt.Errorf("failed to read env file for %q: %v", file, err)
+		}
+		jobsConfig.Env = append(envs, jobsConfig.Env...)
 	}
 
+	return cli.NormalizeJobsConfig(jobsConfig), nil
+}
+
+// NormalizeJobsConfig fills in the defaults of the jobs config as it is read
+// by ReadJobsConfig, without converting it to Prow jobs: the branches default
+// to the default branch, and the common config of the base config is merged
+// into the file and its jobs. The jobs config must not have been normalized
+// already, since the lists of the layers are appended when they are merged.
+func (cli *Client) NormalizeJobsConfig(jobsConfig spec.JobsConfig) spec.JobsConfig {
 	if len(jobsConfig.Branches) == 0 {
-		jobsConfig.Branches = []string{"master"}
+		jobsConfig.Branches = []string{cli.defaultBranch()}
 	}
+	jobsConfig.FileResourcePresets = sets.StringKeySet(jobsConfig.ResourcePresets).List()
+
+	return resolveOverwrites(cli.BaseConfig.MergeResourcePresets, cli.BaseConfig.CommonConfig.DeepCopy(), jobsConfig)
+}
 
-	return resolveOverwrites(cli.BaseConfig.CommonConfig.DeepCopy(), jobsConfig)
+// parseEnvFile parses the environment variables from the content of a file of
+// KEY=VALUE lines. Blank lines and lines starting with # are ignored.
+func parseEnvFile(file string, bs []byte) ([]v1.EnvVar, error) {
+	envs := []v1.EnvVar{}
+	for i, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("%s:%d: line must take the form KEY=VALUE", file, i+1)
+		}
+		value := strings.TrimSpace(kv[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		envs = append(envs, v1.EnvVar{Name: key, Value: value})
+	}
+	return envs, nil
 }
 
 func deepCopyMap(mp map[string]string) map[string]string {
@@ -106,30 +284,75 @@ func deepCopyMap(mp map[string]string) map[string]string {
 	return newMap
 }
 
-func mergeCommonConfig(configs ...spec.CommonConfig) spec.CommonConfig {
+func mergeCommonConfig(mergeResources bool, configs ...spec.CommonConfig) spec.CommonConfig {
 	mergedCommonConfig := spec.CommonConfig{}
 	for i := 0; i < len(configs); i++ {
+		inheritedResources := mergedCommonConfig.DeepCopy().ResourcePresets
 		config := configs[i].DeepCopy()
 		if err := mergo.Merge(&mergedCommonConfig, config,
 			mergo.WithAppendSlice, mergo.WithSliceDeepCopy); err != nil {
 			log.Fatalf("Failed to merge config: %v", err)
 		}
 
+		if mergeResources {
+			for name, resources := range config.ResourcePresets {
+				if inherited, ok := inheritedResources[name]; ok {
+					mergedCommonConfig.ResourcePresets[name] = mergeResourceRequirements(inherited, resources)
+				}
+			}
+		}
+
 		// NodeSelector field is a special case since for Prow jobs we normally only
 		// want to schedule them on dedicated nodes that only matches with one
 		// single label.
 		if len(configs[i].NodeSelector) != 0 {
 			mergedCommonConfig.NodeSelector = deepCopyMap(configs[i].NodeSelector)
 		}
+
+		// Interval and Cron are alternative schedules, so the schedule inherited
+		// from the layers above is replaced when either of them is set.
+		if configs[i].Interval != "" || configs[i].Cron != "" {
+			mergedCommonConfig.Interval = configs[i].Interval
+			mergedCommonConfig.Cron = configs[i].Cron
+		}
 	}
 	return mergedCommonConfig
 }
 
-func resolveOverwrites(baseCommonConfig spec.CommonConfig, jobsConfig spec.JobsConfig) spec.JobsConfig {
-	jobsConfig.CommonConfig = mergeCommonConfig(baseCommonConfig, jobsConfig.CommonConfig)
+// mergeResourceRequirements overlays each of the requests and limits of the
+// overlay on the base resource requirements.
+func mergeResourceRequirements(base, overlay v1.ResourceRequirements) v1.ResourceRequirements {
+	merged := *base.DeepCopy()
+	if len(overlay.Requests) != 0 && merged.Requests == nil {
+		merged.Requests = v1.ResourceList{}
+	}
+	for name, quantity := range overlay.Requests {
+		merged.Requests[name] = quantity.DeepCopy()
+	}
+	if len(overlay.Limits) != 0 && merged.Limits == nil {
+		merged.Limits = v1.ResourceList{}
+	}
+	for name, quantity := range overlay.Limits {
+		merged.Limits[name] = quantity.DeepCopy()
+	}
+	return merged
+}
+
+func resolveOverwrites(mergeResources bool, baseCommonConfig spec.CommonConfig, jobsConfig spec.JobsConfig) spec.JobsConfig {
+	if len(jobsConfig.ExcludedBaseRequirements) != 0 {
+		excluded := sets.NewString(jobsConfig.ExcludedBaseRequirements...)
+		var requirements []string
+		for _, req := range baseCommonConfig.Requirements {
+			if !excluded.Has(req) {
+				requirements = append(requirements, req)
+			}
+		}
+		baseCommonConfig.Requirements = requirements
+	}
+	jobsConfig.CommonConfig = mergeCommonConfig(mergeResources, baseCommonConfig, jobsConfig.CommonConfig)
 
 	for i, job := range jobsConfig.Jobs {
-		job.CommonConfig = mergeCommonConfig(jobsConfig.CommonConfig, job.CommonConfig)
+		job.CommonConfig = mergeCommonConfig(mergeResources, jobsConfig.CommonConfig, job.CommonConfig)
 
 		jobsConfig.Jobs[i] = job
 	}
@@ -137,6 +360,19 @@ func resolveOverwrites(baseCommonConfig spec.CommonConfig, jobsConfig spec.JobsC
 	return jobsConfig
 }
 
+// ExplainRequirements returns the names of the requirement presets applied to
+// the job, in the order they are applied, after the requirements of the base,
+// file and job are merged and the excluded ones are removed. It returns nil if
+// there is no such job.
+func ExplainRequirements(jobsConfig spec.JobsConfig, jobName string) []string {
+	for _, job := range jobsConfig.Jobs {
+		if job.Name == jobName {
+			return decorator.EffectiveRequirements(job.Requirements, job.ExcludedRequirements)
+		}
+	}
+	return nil
+}
+
 // FilterReleaseBranchingJobs filters then returns jobs with release branching enabled.
 func FilterReleaseBranchingJobs(jobs []spec.Job) []spec.Job {
 	jobsF := make([]spec.Job, 0)
@@ -149,76 +385,20 @@ func FilterReleaseBranchingJobs(jobs []spec.Job) []spec.Job {
 	return jobsF
 }
 
-func validateJobsConfig(fileName string, jobsConfig spec.JobsConfig) error {
-	var err error
-	if jobsConfig.Org == "" {
-		err = multierror.Append(err, fmt.Errorf("%s: org must be set", fileName))
-	}
-	if jobsConfig.Repo == "" {
-		err = multierror.Append(err, fmt.Errorf("%s: repo must be set", fileName))
-	}
-
-	for _, job := range jobsConfig.Jobs {
-		if jobsConfig.Org == "istio" || jobsConfig.Org == "istio-private" {
-			// Some other orgs may have other naming conventions, but for Istio we use _ as divider between job
-			// name, repo, and type. So exclude it from the name.
-			if strings.Contains(job.Name, "_") {
-				err = multierror.Append(err, fmt.Errorf("%s: job may not contain '_' %v", fileName, job.Name))
-			}
-		}
-		if job.Image == "" {
-			err = multierror.Append(err, fmt.Errorf("%s: image must be set for job %v", fileName, job.Name))
-		}
-		if job.Resources != "" {
-			if _, f := jobsConfig.ResourcePresets[job.Resources]; !f {
-				err = multierror.Append(err, fmt.Errorf("%s: job '%v' has nonexistant resource '%v'", fileName, job.Name, job.Resources))
-			}
-		}
-
-		if sets.NewString(job.Types...).Has(TypePeriodic) {
-			if job.Cron != "" && job.Interval != "" {
-				err = multierror.Append(err, fmt.Errorf("%s: cron and interval cannot be both set in periodic %s", fileName, job.Name))
-			} else if job.Cron == "" && job.Interval == "" {
-				err = multierror.Append(err, fmt.Errorf("%s: cron and interval cannot be both empty in periodic %s", fileName, job.Name))
-			} else if job.Cron != "" {
-				if _, e := cron.Parse(job.Cron); e != nil {
-					err = multierror.Append(err, fmt.Errorf("%s: invalid cron string %s in periodic %s: %v", fileName, job.Cron, job.Name, e))
-				}
-			} else if job.Interval != "" {
-				if _, e := time.ParseDuration(job.Interval); e != nil {
-					err = multierror.Append(err, fmt.Errorf("%s: cannot parse duration %s in periodic %s: %v", fileName, job.Interval, job.Name, e))
-				}
-			}
-		}
-		for _, t := range job.Types {
-			if e := validate(t, sets.NewString(TypePostsubmit, TypePresubmit, TypePeriodic), "type"); e != nil {
-				err = multierror.Append(err, e)
-			}
-		}
-		for _, t := range job.Architectures {
-			if e := validate(t, sets.NewString(ArchAMD64, ArchARM64, TypePeriodic), "architectures"); e != nil {
-				err = multierror.Append(err, e)
-			}
-		}
-		for _, repo := range job.Repos {
-			if len(strings.Split(repo, "/")) != 2 {
-				err = multierror.Append(err, fmt.Errorf("%s: repo %v not valid, should take form org/repo", fileName, repo))
-			}
-		}
-	}
-
-	return err
-}
-
 func (cli *Client) ConvertJobConfig(fileName string, jobsConfig spec.JobsConfig, branch string) (config.JobConfig, error) {
 	output := config.JobConfig{
 		PresubmitsStatic:  map[string][]config.Presubmit{},
 		PostsubmitsStatic: map[string][]config.Postsubmit{},
 		Periodics:         []config.Periodic{},
 	}
-	if err := validateJobsConfig(fileName, jobsConfig); err != nil {
+	res := cli.ValidateJobsConfig(fileName, jobsConfig)
+	if err := res.Err(cli.Strict); err != nil {
 		return output, err
 	}
+	cli.logWarnings(res.Warnings)
+	// Problems found when comparing the generated jobs, reported once all of
+	// them are generated.
+	lint := ValidationResult{}
 
 	baseConfig := cli.BaseConfig
 	testgridConfig := baseConfig.TestgridConfig
@@ -226,36 +406,37 @@ func (cli *Client) ConvertJobConfig(fileName string, jobsConfig spec.JobsConfig,
 	var presubmits []config.Presubmit
 	var postsubmits []config.Postsubmit
 	var periodics []config.Periodic
+	// The presubmits that are only optional on the branch they are generated
+	// for.
+	branchOptional := sets.NewString()
 
 	for _, parentJob := range jobsConfig.Jobs {
-		if len(parentJob.Architectures) == 0 {
-			parentJob.Architectures = []string{ArchAMD64}
+		if sets.NewString(parentJob.ExcludedBranches...).Has(branch) {
+			continue
 		}
-
-		expandedJobs := decorator.ApplyVariables(parentJob, parentJob.Architectures, jobsConfig.Params, jobsConfig.Matrix, cli.BaseConfig.ClusterOverrides)
+		expandedJobs := cli.expandJob(jobsConfig, parentJob)
 		for _, job := range expandedJobs {
+			hidden := sets.NewString(job.Modifiers...).Has(decorator.ModifierHidden)
 			brancher := config.Brancher{
 				Branches: []string{fmt.Sprintf("^%s$", branch)},
 			}
 
 			testgridJobPrefix := jobsConfig.Org
-			if branch != "master" {
-				testgridJobPrefix += "_" + branch
+			if branch != cli.defaultBranch() {
+				testgridJobPrefix += cli.nameSeparator() + branch
 			}
-			testgridJobPrefix += "_" + jobsConfig.Repo
+			testgridJobPrefix += cli.nameSeparator() + jobsConfig.Repo
 
+			var presubmit *config.Presubmit
 			if len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePresubmit) {
-				name := fmt.Sprintf("%s_%s", job.Name, jobsConfig.Repo)
-				if branch != "master" {
-					name += "_" + branch
-				}
+				name := cli.jobName(job, jobsConfig.Repo, branch, TypePresubmit)
 
-				base, err := cli.createJobBase(baseConfig, jobsConfig, job, name, branch, jobsConfig.ResourcePresets)
+				base, err := cli.createJobBase(baseConfig, jobsConfig, withTypeImage(job, TypePresubmit), name, branch, jobsConfig.ResourcePresets)
 				if err != nil {
 					return output, err
 				}
 
-				presubmit := config.Presubmit{
+				presubmit = &config.Presubmit{
 					JobBase:   base,
 					AlwaysRun: true,
 					Brancher:  brancher,
@@ -266,12 +447,32 @@ func (cli *Client) ConvertJobConfig(fileName string, jobsConfig spec.JobsConfig,
 				if pa, ok := baseConfig.PathAliases[jobsConfig.Org]; ok {
 					presubmit.UtilityConfig.PathAlias = fmt.Sprintf("%s/%s", pa, jobsConfig.Repo)
 				}
+				presubmit.UtilityConfig.CloneURI = cloneURI(jobsConfig, job)
 				if job.Regex != "" {
 					presubmit.RegexpChangeMatcher = config.RegexpChangeMatcher{
 						RunIfChanged: job.Regex,
 					}
 					presubmit.AlwaysRun = false
 				}
+				if job.SkipRegex != "" {
+					presubmit.RegexpChangeMatcher = config.RegexpChangeMatcher{
+						SkipIfOnlyChanged: job.SkipRegex,
+					}
+					presubmit.AlwaysRun = false
+				}
+				if job.ContextGroup != "" {
+					presubmit.Context = presubmitContext(job, name)
+				}
+				if job.TriggerLabel != "" {
+					// The presubmit may never run, so it cannot be required.
+					presubmit.AlwaysRun = false
+					presubmit.Optional = true
+					presubmit.Annotations[TriggerLabelAnnotation] = job.TriggerLabel
+				}
+				if job.BeforeMerge || (job.RunBeforeMerge != nil && *job.RunBeforeMerge) {
+					presubmit.RunBeforeMerge = true
+					presubmit.AlwaysRun = false
+				}
 				triggers := []string{
 					// Allow "/test job"
 					"(" + config.DefaultTriggerFor(job.Name) + ")",
@@ -285,25 +486,38 @@ func (cli *Client) ConvertJobConfig(fileName string, jobsConfig spec.JobsConfig,
 				presubmit.Trigger = strings.Join(triggers, `|`)
 				presubmit.RerunCommand = fmt.Sprintf("/test %s", job.Name)
 				if testgridConfig.Enabled {
-					if err := mergo.Merge(&presubmit.JobBase.Annotations, map[string]string{
+					applyTestgridAnnotations(&presubmit.JobBase, hidden, map[string]string{
 						TestGridDashboard: testgridJobPrefix,
-					}); err != nil {
-						return output, err
+					})
+				}
+				decorator.ApplyModifiersPresubmit(presubmit, job.Modifiers)
+				if job.Optional != nil {
+					presubmit.Optional = *job.Optional
+				}
+				if len(job.OptionalBranches) != 0 {
+					optionalOn := config.Brancher{}
+					for _, b := range job.OptionalBranches {
+						optionalOn.Branches = append(optionalOn.Branches, fmt.Sprintf("^%s$", b))
+					}
+					if matchesBranch(optionalOn, branch) {
+						presubmit.Optional = true
+						branchOptional.Insert(presubmit.Name)
 					}
 				}
-				decorator.ApplyModifiersPresubmit(&presubmit, job.Modifiers)
+				if job.SkipReport != nil {
+					presubmit.SkipReport = *job.SkipReport
+				}
 				decorator.ApplyRequirements(baseConfig, &presubmit.JobBase, job.Requirements, job.ExcludedRequirements, jobsConfig.RequirementPresets)
-				presubmits = append(presubmits, presubmit)
+				applyProtectedMetadata(&presubmit.JobBase, baseConfig)
+				decorator.ApplyJobMetadata(&presubmit.JobBase, jobMetadata(jobsConfig, name, branch))
+				presubmits = append(presubmits, *presubmit)
+				cli.checkPrivileged(&lint, fileName, job.Name, presubmit.JobBase)
 			}
 
 			if len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePostsubmit) {
-				name := fmt.Sprintf("%s_%s", job.Name, jobsConfig.Repo)
-				if branch != "master" {
-					name += "_" + branch
-				}
-				name += "_postsubmit"
+				name := cli.jobName(job, jobsConfig.Repo, branch, TypePostsubmit)
 
-				base, err := cli.createJobBase(baseConfig, jobsConfig, job, name, branch, jobsConfig.ResourcePresets)
+				base, err := cli.createJobBase(baseConfig, jobsConfig, withTypeImage(job, TypePostsubmit), name, branch, jobsConfig.ResourcePresets)
 				if err != nil {
 					return output, err
 				}
@@ -312,68 +526,98 @@ func (cli *Client) ConvertJobConfig(fileName string, jobsConfig spec.JobsConfig,
 					JobBase:  base,
 					Brancher: brancher,
 				}
+				for _, b := range job.PostsubmitSkipBranches {
+					postsubmit.SkipBranches = append(postsubmit.SkipBranches, fmt.Sprintf("^%s$", b))
+				}
 				if job.GerritPostsubmitLabel != "" {
 					postsubmit.Labels[kube.GerritReportLabel] = job.GerritPostsubmitLabel
 				}
 				if pa, ok := baseConfig.PathAliases[jobsConfig.Org]; ok {
 					postsubmit.UtilityConfig.PathAlias = fmt.Sprintf("%s/%s", pa, jobsConfig.Repo)
 				}
+				postsubmit.UtilityConfig.CloneURI = cloneURI(jobsConfig, job)
 				if job.Regex != "" {
 					postsubmit.RegexpChangeMatcher = config.RegexpChangeMatcher{
 						RunIfChanged: job.Regex,
 					}
 				}
-				if testgridConfig.Enabled {
-					if err := mergo.Merge(&postsubmit.JobBase.Annotations, map[string]string{
-						TestGridDashboard:   testgridJobPrefix + "_postsubmit",
-						TestGridAlertEmail:  testgridConfig.AlertEmail,
-						TestGridNumFailures: testgridConfig.NumFailuresToAlert,
-					}); err != nil {
-						return output, err
+				if job.SkipRegex != "" {
+					postsubmit.RegexpChangeMatcher = config.RegexpChangeMatcher{
+						SkipIfOnlyChanged: job.SkipRegex,
 					}
 				}
+				if testgridConfig.Enabled {
+					applyTestgridAnnotations(&postsubmit.JobBase, hidden, map[string]string{
+						TestGridDashboard:      testgridJobPrefix + cli.nameSeparator() + TypePostsubmit,
+						TestGridAlertEmail:     testgridConfig.AlertEmail,
+						TestGridNumFailures:    testgridConfig.NumFailuresToAlert,
+						TestGridDashboardGroup: job.DashboardGroup,
+					})
+				}
 				decorator.ApplyModifiersPostsubmit(&postsubmit, job.Modifiers)
+				if job.SkipReport != nil {
+					postsubmit.SkipReport = *job.SkipReport
+				}
 				decorator.ApplyRequirements(baseConfig, &postsubmit.JobBase, job.Requirements, job.ExcludedRequirements, jobsConfig.RequirementPresets)
+				applyProtectedMetadata(&postsubmit.JobBase, baseConfig)
+				decorator.ApplyJobMetadata(&postsubmit.JobBase, jobMetadata(jobsConfig, name, branch))
 				postsubmits = append(postsubmits, postsubmit)
+				cli.checkPrivileged(&lint, fileName, job.Name, postsubmit.JobBase)
+				if !matchesBranch(postsubmit.Brancher, branch) {
+					lint.addWarningf("%s: postsubmit %v never runs, its branch settings exclude branch %s", fileName, job.Name, branch)
+				}
+
+				if presubmit != nil && !job.AllowVariantDivergence {
+					if e := checkVariantDivergence(presubmit.JobBase, postsubmit.JobBase, job); e != nil {
+						lint.addWarningf("%s: job %v: %v", fileName, job.Name, e)
+					}
+				}
 			}
 
 			if sets.NewString(job.Types...).Has(TypePeriodic) {
-				name := fmt.Sprintf("%s_%s", job.Name, jobsConfig.Repo)
-				if branch != "master" {
-					name += "_" + branch
-				}
-				name += "_periodic"
+				for _, job := range periodicSchedules(job) {
+					name := cli.jobName(job, jobsConfig.Repo, branch, TypePeriodic)
 
-				// For periodic jobs, the repo needs to be added to the clonerefs and its root directory
-				// should be set as the working directory, so add itself to the repo list here.
-				job.Repos = append([]string{jobsConfig.Org + "/" + jobsConfig.Repo}, job.Repos...)
+					// For periodic jobs, the repo needs to be added to the clonerefs and its root directory
+					// should be set as the working directory, so add itself to the front of the repo list here.
+					job.Repos = withPrimaryRepo(jobsConfig.Org+"/"+jobsConfig.Repo, job.Repos)
 
-				base, err := cli.createJobBase(baseConfig, jobsConfig, job, name, branch, jobsConfig.ResourcePresets)
-				if err != nil {
-					return output, err
-				}
-				periodic := config.Periodic{
-					JobBase:  base,
-					Interval: job.Interval,
-					Cron:     job.Cron,
-					Tags:     job.Tags,
-				}
-				for _, requirement := range job.Requirements {
-					if cronstr := jobsConfig.RequirementPresets[requirement].Cron; cronstr != "" {
-						periodic.Cron = cronstr
-					}
-				}
-				if testgridConfig.Enabled {
-					if err := mergo.Merge(&periodic.JobBase.Annotations, map[string]string{
-						TestGridDashboard:   testgridJobPrefix + "_periodic",
-						TestGridAlertEmail:  testgridConfig.AlertEmail,
-						TestGridNumFailures: testgridConfig.NumFailuresToAlert,
-					}); err != nil {
+					base, err := cli.createJobBase(baseConfig, jobsConfig, withTypeImage(job, TypePeriodic), name, branch, jobsConfig.ResourcePresets)
+					if err != nil {
 						return output, err
 					}
+					periodic := config.Periodic{
+						JobBase:  base,
+						Interval: normalizeInterval(job.Interval),
+						Cron:     job.Cron,
+						Tags:     job.Tags,
+					}
+					if uri := cloneURI(jobsConfig, job); uri != "" {
+						periodic.ExtraRefs[0].CloneURI = uri
+					}
+					for _, requirement := range job.Requirements {
+						if cronstr := jobsConfig.RequirementPresets[requirement].Cron; cronstr != "" && periodic.Interval == "" {
+							periodic.Cron = cronstr
+						}
+					}
+					if job.Jitter != "" {
+						periodic.Cron = applyJitter(periodic.Cron, name, job.Jitter)
+					}
+					if testgridConfig.Enabled {
+						applyTestgridAnnotations(&periodic.JobBase, hidden, map[string]string{
+							TestGridDashboard:      testgridJobPrefix + cli.nameSeparator() + TypePeriodic,
+							TestGridAlertEmail:     testgridConfig.AlertEmail,
+							TestGridNumFailures:    testgridConfig.NumFailuresToAlert,
+							TestGridDashboardGroup: job.DashboardGroup,
+						})
+					}
+					decorator.ApplyModifiersPeriodic(&periodic, job.Modifiers)
+					decorator.ApplyRequirements(baseConfig, &periodic.JobBase, job.Requirements, job.ExcludedRequirements, jobsConfig.RequirementPresets)
+					applyProtectedMetadata(&periodic.JobBase, baseConfig)
+					decorator.ApplyJobMetadata(&periodic.JobBase, jobMetadata(jobsConfig, name, branch))
+					periodics = append(periodics, periodic)
+					cli.checkPrivileged(&lint, fileName, job.Name, periodic.JobBase)
 				}
-				decorator.ApplyRequirements(baseConfig, &periodic.JobBase, job.Requirements, job.ExcludedRequirements, jobsConfig.RequirementPresets)
-				periodics = append(periodics, periodic)
 			}
 		}
 
@@ -387,25 +631,352 @@ func (cli *Client) ConvertJobConfig(fileName string, jobsConfig spec.JobsConfig,
 			output.Periodics = periodics
 		}
 	}
+	// GitHub only keeps the latest status of each context.
+	contexts := map[string]string{}
+	for _, p := range presubmits {
+		// A presubmit that always runs but never blocks merging is usually
+		// meant to be either required or conditional.
+		if p.AlwaysRun && p.Optional && p.RunIfChanged == "" && p.SkipIfOnlyChanged == "" && !branchOptional.Has(p.Name) {
+			lint.addWarningf("%s: presubmit %s always runs but is optional, consider making it required or setting a regex", fileName, p.Name)
+		}
+		context := githubContext(p)
+		if other, ok := contexts[context]; ok {
+			lint.addErrorf("%s: presubmits %s and %s have the same context %s", fileName, other, p.Name, context)
+			continue
+		}
+		contexts[context] = p.Name
+	}
+	if err := lint.Err(cli.Strict); err != nil {
+		return output, err
+	}
+	cli.logWarnings(lint.Warnings)
 	return output, nil
 }
 
-func createContainer(jobConfig spec.JobsConfig, job spec.Job, resources map[string]v1.ResourceRequirements) []v1.Container {
+// githubContext returns the GitHub context of the generated presubmit, which
+// Prow defaults to its name.
+func githubContext(p config.Presubmit) string {
+	if p.Context != "" {
+		return p.Context
+	}
+	return p.Name
+}
+
+// logWarnings logs the warnings the client has not logged before, so that the
+// warnings of a file are logged once instead of once per branch.
+func (cli *Client) logWarnings(warnings []error) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if cli.warned == nil {
+		cli.warned = sets.NewString()
+	}
+	for _, w := range warnings {
+		if !cli.warned.Has(w.Error()) {
+			cli.warned.Insert(w.Error())
+			log.Printf("Warning: %v", w)
+		}
+	}
+}
+
+// ConvertJobConfigFiltered converts the meta config like ConvertJobConfig, but
+// only for the jobs whose names are in include, or all of them if include is
+// empty, and are not in exclude. The names are matched before suffixing.
+func (cli *Client) ConvertJobConfigFiltered(fileName string, jobsConfig spec.JobsConfig, branch string, include, exclude []string) (config.JobConfig, error) {
+	included, excluded := sets.NewString(include...), sets.NewString(exclude...)
+	jobs := make([]spec.Job, 0, len(jobsConfig.Jobs))
+	for _, job := range jobsConfig.Jobs {
+		if (included.Len() == 0 || included.Has(job.Name)) && !excluded.Has(job.Name) {
+			jobs = append(jobs, job)
+		}
+	}
+	jobsConfig.Jobs = jobs
+	return cli.ConvertJobConfig(fileName, jobsConfig, branch)
+}
+
+// ConvertJobConfigWithOverlay converts the meta config like ConvertJobConfig,
+// after patching the file and all its jobs with the named overlay.
+func (cli *Client) ConvertJobConfigWithOverlay(fileName string, jobsConfig spec.JobsConfig, branch, overlay string) (config.JobConfig, error) {
+	jobsConfig, err := ApplyOverlay(fileName, jobsConfig, overlay)
+	if err != nil {
+		return config.JobConfig{}, err
+	}
+	return cli.ConvertJobConfig(fileName, jobsConfig, branch)
+}
+
+// ApplyOverlay returns a copy of the meta config with the file and all its jobs
+// patched with the named overlay, or an error if the file has no such overlay.
+func ApplyOverlay(fileName string, jobsConfig spec.JobsConfig, overlay string) (spec.JobsConfig, error) {
+	o, ok := jobsConfig.Overlays[overlay]
+	if !ok {
+		return jobsConfig, fmt.Errorf("%s: unknown overlay %s", fileName, overlay)
+	}
+	jobsConfig.CommonConfig = applyOverlay(jobsConfig.CommonConfig, o)
+	jobs := make([]spec.Job, 0, len(jobsConfig.Jobs))
+	for _, job := range jobsConfig.Jobs {
+		job.CommonConfig = applyOverlay(job.CommonConfig, o)
+		jobs = append(jobs, job)
+	}
+	jobsConfig.Jobs = jobs
+	return jobsConfig, nil
+}
+
+// applyOverlay returns a copy of the config with the fields set in the overlay
+// replaced.
+func applyOverlay(commonConfig spec.CommonConfig, overlay spec.Overlay) spec.CommonConfig {
+	merged := commonConfig.DeepCopy()
+	if overlay.Cluster != "" {
+		merged.Cluster = overlay.Cluster
+	}
+	if overlay.GCSLogBucket != "" {
+		merged.GCSLogBucket = overlay.GCSLogBucket
+	}
+	if overlay.GCSConfiguration != nil {
+		merged.GCSConfiguration = overlay.GCSConfiguration.DeepCopy()
+	}
+	if len(overlay.ResourcePresets) != 0 && merged.ResourcePresets == nil {
+		merged.ResourcePresets = map[string]v1.ResourceRequirements{}
+	}
+	for name, resources := range overlay.ResourcePresets {
+		merged.ResourcePresets[name] = *resources.DeepCopy()
+	}
+	return merged
+}
+
+// ConvertJobConfigForBranches converts the meta config for each of its
+// branches, and returns the generated config keyed by branch. An error is
+// returned if the same job name is generated for more than one branch.
+func (cli *Client) ConvertJobConfigForBranches(fileName string, jobsConfig spec.JobsConfig) (map[string]config.JobConfig, error) {
+	outputs := map[string]config.JobConfig{}
+	// The branch each job name was first generated for, keyed by job type.
+	seen := map[string]map[string]string{TypePresubmit: {}, TypePostsubmit: {}, TypePeriodic: {}}
+	var err error
+	check := func(jobType, name, branch string) {
+		if b, ok := seen[jobType][name]; ok && b != branch {
+			err = multierror.Append(err, fmt.Errorf("%s: %s %s is generated for both branch %s and %s", fileName, jobType, name, b, branch))
+			return
+		}
+		seen[jobType][name] = branch
+	}
+	for _, branch := range jobsConfig.Branches {
+		output, e := cli.ConvertJobConfig(fileName, jobsConfig, branch)
+		if e != nil {
+			return nil, e
+		}
+		for _, presubmits := range output.PresubmitsStatic {
+			for _, p := range presubmits {
+				check(TypePresubmit, p.Name, branch)
+			}
+		}
+		for _, postsubmits := range output.PostsubmitsStatic {
+			for _, p := range postsubmits {
+				check(TypePostsubmit, p.Name, branch)
+			}
+		}
+		for _, p := range output.Periodics {
+			check(TypePeriodic, p.Name, branch)
+		}
+		outputs[branch] = output
+	}
+	return outputs, err
+}
+
+// expandJob expands the job into the jobs for each architecture and matrix
+// combination.
+func (cli *Client) expandJob(jobsConfig spec.JobsConfig, job spec.Job) []spec.Job {
+	return decorator.ApplyVariables(job, job.Architectures, jobsConfig.Params, jobsConfig.Matrix, cli.BaseConfig.ClusterOverrides)
+}
+
+// periodicSchedules returns the job once for each periodic generated for it. A
+// job with an interval fallback is split into a cron periodic and an interval
+// periodic, since a Prow periodic cannot have both schedules.
+func periodicSchedules(job spec.Job) []spec.Job {
+	if !job.IntervalFallback {
+		return []spec.Job{job}
+	}
+	cronJob, intervalJob := job, job
+	cronJob.Name += "-cron"
+	cronJob.Interval = ""
+	intervalJob.Name += "-interval"
+	intervalJob.Cron = ""
+	intervalJob.Jitter = ""
+	return []spec.Job{cronJob, intervalJob}
+}
+
+// withTypeImage returns the job with its image replaced by the image configured
+// for the job type, if there is one.
+func withTypeImage(job spec.Job, jobType string) spec.Job {
+	image := map[string]string{
+		TypePresubmit:  job.PresubmitImage,
+		TypePostsubmit: job.PostsubmitImage,
+		TypePeriodic:   job.PeriodicImage,
+	}[jobType]
+	if image != "" {
+		job.Image = image
+	}
+	return job
+}
+
+// jobMetadata returns the metadata of the generated job, which can be
+// referenced as $(job.key) in its labels, annotations and env values.
+func jobMetadata(jobsConfig spec.JobsConfig, name, branch string) map[string]string {
+	return map[string]string{
+		"name":   name,
+		"repo":   jobsConfig.Repo,
+		"org":    jobsConfig.Org,
+		"branch": branch,
+	}
+}
+
+// defaultBranch returns the configured default branch of the repos.
+func (cli *Client) defaultBranch() string {
+	if cli.BaseConfig.DefaultBranch != "" {
+		return cli.BaseConfig.DefaultBranch
+	}
+	return "master"
+}
+
+// nameSeparator returns the configured separator of the generated job names.
+func (cli *Client) nameSeparator() string {
+	if cli.BaseConfig.NameSeparator != "" {
+		return cli.BaseConfig.NameSeparator
+	}
+	return "_"
+}
+
+// maxTimeout returns the configured maximum timeout of the jobs.
+func (cli *Client) maxTimeout() time.Duration {
+	if cli.BaseConfig.MaxTimeout != nil {
+		return cli.BaseConfig.MaxTimeout.Duration
+	}
+	return 24 * time.Hour
+}
+
+// jobName returns the name of the generated Prow job of the given type, which
+// takes the form of name_repo[_branch][_type], joined by the name separator.
+// Jobs for the default branch are not suffixed with the branch, and presubmits
+// are not suffixed with the type.
+func (cli *Client) jobName(job spec.Job, repo, branch, jobType string) string {
+	sep := cli.nameSeparator()
+	name := job.Name + sep + repo
+	if branch != cli.defaultBranch() {
+		name += sep + branch
+	}
+	if jobType != TypePresubmit {
+		name += sep + jobType
+	}
+	return name
+}
+
+// PresubmitContexts returns the contexts of the presubmits that will be
+// generated for the given branch, after the matrix expansion and suffixing.
+// Presubmits reported to Gerrit do not have a GitHub context, and are skipped.
+func (cli *Client) PresubmitContexts(jobsConfig spec.JobsConfig, branch string) []string {
+	contexts := []string{}
+	for _, parentJob := range jobsConfig.Jobs {
+		if sets.NewString(parentJob.ExcludedBranches...).Has(branch) {
+			continue
+		}
+		for _, job := range cli.expandJob(jobsConfig, parentJob) {
+			if job.GerritPresubmitLabel != "" {
+				continue
+			}
+			if len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePresubmit) {
+				contexts = append(contexts, presubmitContext(job, cli.jobName(job, jobsConfig.Repo, branch, TypePresubmit)))
+			}
+		}
+	}
+	return contexts
+}
+
+// ReferencedImages returns all the distinct images the jobs of the meta configs
+// run, after the matrix expansion. The images are collected from the containers
+// the jobs resolve to for each of their types, including the sidecars added by
+// their requirements.
+func (cli *Client) ReferencedImages(configs []spec.JobsConfig) []string {
+	images := sets.NewString()
+	for _, jobsConfig := range configs {
+		for _, parentJob := range jobsConfig.Jobs {
+			for _, job := range cli.expandJob(jobsConfig, parentJob) {
+				types := job.Types
+				if len(types) == 0 {
+					types = []string{TypePresubmit, TypePostsubmit}
+				}
+				for _, jobType := range types {
+					jb := config.JobBase{
+						Labels:      map[string]string{},
+						Annotations: map[string]string{},
+						Spec: &v1.PodSpec{
+							Containers: createContainer(jobsConfig, withTypeImage(job, jobType), jobsConfig.ResourcePresets,
+								cli.BaseConfig.FallbackResources),
+						},
+					}
+					decorator.ApplyRequirements(cli.BaseConfig, &jb, job.Requirements, job.ExcludedRequirements, jobsConfig.RequirementPresets)
+					for _, c := range append(append([]v1.Container(nil), jb.Spec.InitContainers...), jb.Spec.Containers...) {
+						if c.Image != "" {
+							images.Insert(c.Image)
+						}
+					}
+				}
+			}
+		}
+	}
+	return images.List()
+}
+
+// presubmitContext returns the GitHub status context of the presubmit with the
+// given name, which is prefixed with the context group of the job if it is set.
+func presubmitContext(job spec.Job, name string) string {
+	if job.ContextGroup == "" {
+		return name
+	}
+	return job.ContextGroup + "/" + name
+}
+
+// applyTestgridAnnotations adds the computed testgrid annotations to the job.
+// Annotations that are explicitly set on the job take precedence over the
+// computed ones. Hidden jobs are not added to any testgrid dashboard.
+func applyTestgridAnnotations(jb *config.JobBase, hidden bool, annotations map[string]string) {
+	if hidden {
+		annotations = map[string]string{TestGridCreateGroup: "false"}
+	}
+	for k, v := range annotations {
+		if v == "" {
+			continue
+		}
+		if _, ok := jb.Annotations[k]; !ok {
+			jb.Annotations[k] = v
+		}
+	}
+}
+
+func createContainer(jobConfig spec.JobsConfig, job spec.Job, resources map[string]v1.ResourceRequirements,
+	fallbackResources *v1.ResourceRequirements) []v1.Container {
 	envs := joinEnv(jobConfig.Env, job.Env)
 
-	yes := true
+	privileged := true
+	if job.Privileged != nil {
+		privileged = *job.Privileged
+	}
 	c := v1.Container{
 		Image:           job.Image,
-		SecurityContext: &v1.SecurityContext{Privileged: &yes},
+		SecurityContext: &v1.SecurityContext{Privileged: &privileged},
 		Command:         job.Command,
 		Args:            job.Args,
 		Env:             envs,
+		Ports:           job.Ports,
+		VolumeMounts:    append([]v1.VolumeMount(nil), job.VolumeMounts...),
 	}
 	if job.ImagePullPolicy != "" {
 		c.ImagePullPolicy = v1.PullPolicy(job.ImagePullPolicy)
+	} else if isLatestImage(job.Image) {
+		// Mirror the Kubernetes default, so that it is explicit in the generated
+		// config that floating tags are always pulled.
+		c.ImagePullPolicy = v1.PullAlways
 	}
 
-	decorator.ApplyResource(&c, job.Resources, resources)
+	if !decorator.ApplyResource(&c, job.Resources, resources) && fallbackResources != nil {
+		c.Resources = *fallbackResources.DeepCopy()
+	}
 
 	return []v1.Container{c}
 }
@@ -437,6 +1008,21 @@ func joinEnv(envs ...[]v1.EnvVar) []v1.EnvVar {
 	return res
 }
 
+// BuildJobBase returns the JobBase the job resolves to for the branch, with its
+// requirements applied, as it would be generated for a presubmit. The job must
+// be one of the jobs of the jobsConfig, and is not expanded for its matrix.
+func (cli *Client) BuildJobBase(jobsConfig spec.JobsConfig, job spec.Job, branch string) (config.JobBase, error) {
+	name := cli.jobName(job, jobsConfig.Repo, branch, TypePresubmit)
+	jb, err := cli.createJobBase(cli.BaseConfig, jobsConfig, job, name, branch, jobsConfig.ResourcePresets)
+	if err != nil {
+		return jb, err
+	}
+	decorator.ApplyRequirements(cli.BaseConfig, &jb, job.Requirements, job.ExcludedRequirements, jobsConfig.RequirementPresets)
+	applyProtectedMetadata(&jb, cli.BaseConfig)
+	decorator.ApplyJobMetadata(&jb, jobMetadata(jobsConfig, name, branch))
+	return jb, nil
+}
+
 func (cli *Client) createJobBase(baseConfig spec.BaseConfig, jobConfig spec.JobsConfig, job spec.Job,
 	name string, branch string, resources map[string]v1.ResourceRequirements) (config.JobBase, error,
 ) {
@@ -450,8 +1036,10 @@ func (cli *Client) createJobBase(baseConfig spec.BaseConfig, jobConfig spec.Jobs
 		Name:           name,
 		MaxConcurrency: job.MaxConcurrency,
 		Spec: &v1.PodSpec{
-			Containers:   createContainer(jobConfig, job, resources),
+			Containers:   createContainer(jobConfig, job, resources, baseConfig.FallbackResources),
 			NodeSelector: job.NodeSelector,
+			// Copy the volumes since the requirements append to them.
+			Volumes: append([]v1.Volume(nil), job.Volumes...),
 			// Disable mounting the service account token. None of our jobs should ever be connecting to the API server.
 			// We do use service accounts, but only for GKE workload identity which doesn't require this.
 			// Aside from security concerns, this also triggers https://github.com/kubernetes/kubernetes/issues/99884 which
@@ -462,10 +1050,14 @@ func (cli *Client) createJobBase(baseConfig spec.BaseConfig, jobConfig spec.Jobs
 			Decorate:  &yes,
 			ExtraRefs: createExtraRefs(job.Repos, branch, baseConfig.PathAliases),
 		},
-		ReporterConfig: job.ReporterConfig,
-		Labels:         job.Labels,
-		Annotations:    job.Annotations,
-		Cluster:        job.Cluster,
+		ReporterConfig:  job.ReporterConfig,
+		RerunAuthConfig: job.RerunAuthConfig,
+		ProwJobDefault:  baseConfig.ProwJobDefaults.DeepCopy(),
+		// Copy the maps since they are modified per job type, and the same
+		// job can generate multiple job types.
+		Labels:      deepCopyMap(job.Labels),
+		Annotations: deepCopyMap(job.Annotations),
+		Cluster:     resolveCluster(baseConfig.ClusterAliases, job.Cluster),
 	}
 	if arch, f := job.NodeSelector[v1.LabelArchStable]; f && arch != ArchAMD64 {
 		// Support https://cloud.google.com/kubernetes-engine/docs/how-to/prepare-arm-workloads-for-deployment#multi-arch-schedule-any-arch
@@ -490,14 +1082,56 @@ func (cli *Client) createJobBase(baseConfig spec.BaseConfig, jobConfig spec.Jobs
 	if jb.Annotations == nil {
 		jb.Annotations = map[string]string{}
 	}
+	if baseConfig.BranchLabel != "" {
+		if _, f := jb.Labels[baseConfig.BranchLabel]; !f {
+			jb.Labels[baseConfig.BranchLabel] = branch
+		}
+	}
+	if baseConfig.TeamAnnotation != "" {
+		team := job.Team
+		if team == "" {
+			team = jobConfig.Team
+		}
+		if _, f := jb.Annotations[baseConfig.TeamAnnotation]; !f && team != "" {
+			jb.Annotations[baseConfig.TeamAnnotation] = team
+		}
+	}
 
 	if job.ServiceAccountName != "" {
 		jb.Spec.ServiceAccountName = job.ServiceAccountName
 	}
 
+	if job.PriorityClassName != "" {
+		jb.Spec.PriorityClassName = job.PriorityClassName
+	}
+
+	for _, c := range job.TopologySpreadConstraints {
+		jb.Spec.TopologySpreadConstraints = append(jb.Spec.TopologySpreadConstraints, *c.DeepCopy())
+	}
+
+	for _, t := range job.Tolerations {
+		if !hasToleration(jb.Spec.Tolerations, t) {
+			jb.Spec.Tolerations = append(jb.Spec.Tolerations, *t.DeepCopy())
+		}
+	}
+
+	if job.HostNetwork != nil {
+		jb.Spec.HostNetwork = *job.HostNetwork
+	}
+	if job.DNSPolicy != "" {
+		jb.Spec.DNSPolicy = v1.DNSPolicy(job.DNSPolicy)
+	}
+	if job.DNSConfig != nil {
+		jb.Spec.DNSConfig = job.DNSConfig.DeepCopy()
+	}
+
 	if job.TerminationGracePeriodSeconds != 0 {
 		jb.Spec.TerminationGracePeriodSeconds = &job.TerminationGracePeriodSeconds
 	}
+	if job.ActiveDeadlineSeconds != nil {
+		deadline := *job.ActiveDeadlineSeconds
+		jb.Spec.ActiveDeadlineSeconds = &deadline
+	}
 
 	if job.Timeout != nil {
 		if jb.DecorationConfig == nil {
@@ -505,6 +1139,12 @@ func (cli *Client) createJobBase(baseConfig spec.BaseConfig, jobConfig spec.Jobs
 		}
 		jb.DecorationConfig.Timeout = job.Timeout
 	}
+	if len(job.SSHKeySecrets) != 0 {
+		if jb.DecorationConfig == nil {
+			jb.DecorationConfig = &prowjob.DecorationConfig{}
+		}
+		jb.DecorationConfig.SSHKeySecrets = append([]string(nil), job.SSHKeySecrets...)
+	}
 	if job.GCSLogBucket != "" {
 		if jb.DecorationConfig == nil {
 			jb.DecorationConfig = &prowjob.DecorationConfig{}
@@ -514,10 +1154,79 @@ func (cli *Client) createJobBase(baseConfig spec.BaseConfig, jobConfig spec.Jobs
 			PathStrategy: "explicit",
 		}
 	}
+	if job.GCSConfiguration != nil {
+		if jb.DecorationConfig == nil {
+			jb.DecorationConfig = &prowjob.DecorationConfig{}
+		}
+		gcs := job.GCSConfiguration.DeepCopy()
+		if gcs.Bucket == "" {
+			gcs.Bucket = job.GCSLogBucket
+		}
+		jb.DecorationConfig.GCSConfiguration = gcs
+	}
+	if job.UploadIgnoresInterrupts != nil {
+		if jb.DecorationConfig == nil {
+			jb.DecorationConfig = &prowjob.DecorationConfig{}
+		}
+		v := *job.UploadIgnoresInterrupts
+		jb.DecorationConfig.UploadIgnoresInterrupts = &v
+	}
+	if job.GracePeriod != nil {
+		if jb.DecorationConfig == nil {
+			jb.DecorationConfig = &prowjob.DecorationConfig{}
+		}
+		jb.DecorationConfig.GracePeriod = &prowjob.Duration{Duration: job.GracePeriod.Duration}
+	}
 
 	return jb, nil
 }
 
+// withPrimaryRepo returns the repos with the primary repo as the first one. If
+// the primary repo is already listed, it is moved to the front instead of being
+// added again, so that it is not cloned twice.
+func withPrimaryRepo(primary string, repos []string) []string {
+	res := []string{primary}
+	for _, repo := range repos {
+		if strings.Split(repo, "@")[0] == primary {
+			res[0] = repo
+			continue
+		}
+		res = append(res, repo)
+	}
+	return res
+}
+
+// checkPrivileged reports an error for the privileged containers of the job if
+// the base config forbids them, unless the job is allowed to be privileged.
+func (cli *Client) checkPrivileged(res *ValidationResult, fileName, jobName string, jb config.JobBase) {
+	if !cli.BaseConfig.ForbidPrivileged || jb.Spec == nil || sets.NewString(cli.BaseConfig.PrivilegedJobs...).Has(jobName) {
+		return
+	}
+	var privileged []string
+	for _, c := range append(append([]v1.Container(nil), jb.Spec.InitContainers...), jb.Spec.Containers...) {
+		if c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged {
+			name := c.Name
+			if name == "" {
+				name = decorator.ContainersMain
+			}
+			privileged = append(privileged, name)
+		}
+	}
+	if len(privileged) != 0 {
+		res.addErrorf("%s: job %s has the privileged containers %s, which are forbidden unless the job is in privileged_jobs",
+			fileName, jb.Name, strings.Join(privileged, ", "))
+	}
+}
+
+// cloneURI returns the URI to clone the repo of the file from for the job,
+// which is empty if the repo is cloned from GitHub.
+func cloneURI(jobsConfig spec.JobsConfig, job spec.Job) string {
+	if job.CloneURI != "" {
+		return job.CloneURI
+	}
+	return jobsConfig.CloneURI
+}
+
 func createExtraRefs(extraRepos []string, defaultBranch string, pathAliases map[string]string) []prowjob.Refs {
 	refs := make([]prowjob.Refs, 0)
 	for _, extraRepo := range extraRepos {
@@ -549,9 +1258,111 @@ func createExtraRefs(extraRepos []string, defaultBranch string, pathAliases map[
 	return refs
 }
 
-func validate(input string, options sets.String, description string) error {
-	if !options.Has(input) {
-		return fmt.Errorf("'%v' is not a valid %v. Must be one of %v", input, description, strings.Join(options.List(), ", "))
+// hasToleration returns whether the toleration is in the list, e.g. the
+// toleration of the arch taint that is already added for the arch of the job.
+func hasToleration(tolerations []v1.Toleration, toleration v1.Toleration) bool {
+	for _, t := range tolerations {
+		if t.MatchToleration(&toleration) {
+			return true
+		}
 	}
-	return nil
+	return false
+}
+
+// applyProtectedMetadata sets the protected labels and annotations to their
+// values in the base config, overriding the values set by the job and its
+// requirements.
+func applyProtectedMetadata(jb *config.JobBase, baseConfig spec.BaseConfig) {
+	for _, k := range baseConfig.ProtectedLabels {
+		if v, ok := baseConfig.Labels[k]; ok {
+			jb.Labels[k] = v
+		}
+	}
+	for _, k := range baseConfig.ProtectedAnnotations {
+		if v, ok := baseConfig.Annotations[k]; ok {
+			jb.Annotations[k] = v
+		}
+	}
+}
+
+// normalizeInterval formats the interval in its shortest form, e.g. 60m is
+// formatted as 1h, so equivalent intervals generate the same config. The
+// interval has already been validated by ConvertJobConfig.
+func normalizeInterval(interval string) string {
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return interval
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// applyJitter delays the cron schedule by a number of minutes less than the
+// jitter, derived from the name of the job. The cron is returned unchanged if
+// it cannot be delayed, which the validation of the jitter reports.
+func applyJitter(cronstr, name, jitter string) string {
+	d, err := time.ParseDuration(jitter)
+	if err != nil || d < time.Minute {
+		return cronstr
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	delayed, err := delayCron(cronstr, int(h.Sum32()%uint32(d/time.Minute)))
+	if err != nil {
+		return cronstr
+	}
+	return delayed
+}
+
+// delayCron delays the cron schedule by the minutes. The minutes past the hour
+// are carried into the hour field, which must then be a single hour or *, and
+// the schedule must run every day if the delay carries into the next day.
+func delayCron(cronstr string, minutes int) (string, error) {
+	fields := strings.Fields(cronstr)
+	if len(fields) != 5 {
+		return "", fmt.Errorf("cron %q must have 5 fields", cronstr)
+	}
+	minute, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", fmt.Errorf("cron %q must run at a single minute", cronstr)
+	}
+	total := minute + minutes
+	fields[0] = strconv.Itoa(total % 60)
+	carry := total / 60
+	if carry == 0 {
+		return strings.Join(fields, " "), nil
+	}
+	everyDay := fields[2] == "*" && fields[3] == "*" && fields[4] == "*"
+	if fields[1] == "*" {
+		// An hourly schedule is delayed by the minutes past the hour, unless
+		// it only runs on some days.
+		if !everyDay {
+			return "", fmt.Errorf("cron %q cannot be delayed past the hour, it does not run every day", cronstr)
+		}
+		return strings.Join(fields, " "), nil
+	}
+	hour, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("cron %q cannot be delayed past the hour, it does not run at a single hour", cronstr)
+	}
+	if hour+carry >= 24 && !everyDay {
+		return "", fmt.Errorf("cron %q cannot be delayed past midnight, it does not run every day", cronstr)
+	}
+	fields[1] = strconv.Itoa((hour + carry) % 24)
+	return strings.Join(fields, " "), nil
+}
+
+// resolveCluster returns the cluster the given alias maps to, or the cluster
+// itself if it is not an alias.
+func resolveCluster(aliases map[string]string, cluster string) string {
+	if c, f := aliases[cluster]; f {
+		return c
+	}
+	return cluster
 }
@@ -15,11 +15,25 @@
 package pkg
 
 import (
+	"bytes"
 	"fmt"
+	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
 
 	"istio.io/test-infra/tools/prowgen/pkg/spec"
 )
@@ -67,11 +81,2998 @@ func TestGenerateConfig(t *testing.T) {
 				if err := Check(output, testFile, bc.AutogenHeader); err != nil {
 					t.Fatal(err.Error())
 				}
+				if err := ValidateGeneratedConfig(output); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
+
+// readJobsConfig writes the given meta config to a temporary file and reads it
+// back with the client, so that the base config is overlaid on it.
+func readJobsConfig(t *testing.T, cli *Client, content string) spec.JobsConfig {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "jobs.yaml")
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return cli.ReadJobsConfig(file)
+}
+
+func TestValidateGeneratedConfig(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		name        string
+		config      string
+		expectError bool
+	}{
+		{
+			name: "valid",
+			config: `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  command: [make, test]
+`,
+		},
+		{
+			// Decorated jobs must have a command or args, which is only
+			// enforced by Prow itself.
+			name: "missing command",
+			config: `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+`,
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, tt.config)
+			output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+			if err != nil {
+				t.Fatalf("unexpected conversion error: %v", err)
+			}
+			err = ValidateGeneratedConfig(output)
+			if tt.expectError && err == nil {
+				t.Fatal("expected a Prow validation error, but did not receive one")
+			} else if !tt.expectError && err != nil {
+				t.Fatalf("did not expect an error, but received %v", err)
+			}
+		})
+	}
+}
+
+func TestTestgridAnnotationsOverride(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: custom-dashboard
+  types: [presubmit, postsubmit]
+  command: [make, test]
+  annotations:
+    testgrid-dashboards: my-dashboard
+- name: computed-dashboard
+  types: [presubmit, postsubmit]
+  command: [make, test]
+  annotations:
+    foo: bar
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"custom-dashboard_istio":              "my-dashboard",
+		"custom-dashboard_istio_postsubmit":   "my-dashboard",
+		"computed-dashboard_istio":            "istio_istio",
+		"computed-dashboard_istio_postsubmit": "istio_istio_postsubmit",
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Annotations[TestGridDashboard]
+	}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Annotations[TestGridDashboard]
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("testgrid dashboards do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestRerunAuthConfig(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: deploy
+  types: [presubmit, postsubmit, periodic]
+  interval: 1h
+  command: [make, deploy]
+  rerun_auth_config:
+    github_users: [alice, bob]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &prowjob.RerunAuthConfig{GitHubUsers: []string{"alice", "bob"}}
+	bases := []config.JobBase{
+		output.PresubmitsStatic["istio/istio"][0].JobBase,
+		output.PostsubmitsStatic["istio/istio"][0].JobBase,
+		output.Periodics[0].JobBase,
+	}
+	for _, jb := range bases {
+		if diff := cmp.Diff(want, jb.RerunAuthConfig); diff != "" {
+			t.Errorf("rerun auth config of %s does not match, (-want, +got): \n%s", jb.Name, diff)
+		}
+	}
+
+	jobs.Jobs[0].RerunAuthConfig = &prowjob.RerunAuthConfig{}
+	if _, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master"); err == nil {
+		t.Fatal("expected an error for an empty rerun_auth_config, but did not receive one")
+	}
+}
+
+func TestHiddenModifier(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: hidden
+  types: [presubmit, postsubmit, periodic]
+  interval: 1h
+  command: [make, test]
+  modifiers: [hidden]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bases := []config.JobBase{
+		output.PresubmitsStatic["istio/istio"][0].JobBase,
+		output.PostsubmitsStatic["istio/istio"][0].JobBase,
+		output.Periodics[0].JobBase,
+	}
+	for _, jb := range bases {
+		if !jb.Hidden {
+			t.Errorf("expected %s to be hidden", jb.Name)
+		}
+		if d, f := jb.Annotations[TestGridDashboard]; f {
+			t.Errorf("expected %s to have no testgrid dashboard, got %q", jb.Name, d)
+		}
+		if jb.Annotations[TestGridCreateGroup] != "false" {
+			t.Errorf("expected %s to not create a testgrid test group", jb.Name)
+		}
+	}
+	if !output.PresubmitsStatic["istio/istio"][0].SkipReport {
+		t.Error("expected the hidden presubmit to skip reporting")
+	}
+}
+
+func TestFileLevelDefaults(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+timeout: 2h
+max_concurrency: 3
+jobs:
+- name: inherited
+  types: [presubmit]
+  command: [make, test]
+- name: overridden
+  types: [presubmit]
+  command: [make, test]
+  timeout: 30m
+  max_concurrency: 1
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type defaults struct {
+		Timeout        time.Duration
+		MaxConcurrency int
+	}
+	want := map[string]defaults{
+		"inherited_istio":  {Timeout: 2 * time.Hour, MaxConcurrency: 3},
+		"overridden_istio": {Timeout: 30 * time.Minute, MaxConcurrency: 1},
+	}
+	got := map[string]defaults{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = defaults{Timeout: p.DecorationConfig.Timeout.Get(), MaxConcurrency: p.MaxConcurrency}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("job defaults do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	dir := t.TempDir()
+	envFile := `# shared env
+FILE_ONLY=file
+
+OVERRIDDEN="file"
+key=file
+`
+	if err := os.WriteFile(filepath.Join(dir, "common.env"), []byte(envFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jobsFile := `org: istio
+repo: istio
+image: fooimage
+env_file: common.env
+env:
+- name: OVERRIDDEN
+  value: config
+jobs:
+- name: inherited
+  types: [presubmit]
+  command: [make, test]
+- name: overridden
+  types: [presubmit]
+  command: [make, test]
+  env:
+  - name: FILE_ONLY
+    value: job
+`
+	if err := os.WriteFile(filepath.Join(dir, "jobs.yaml"), []byte(jobsFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jobs := cli.ReadJobsConfig(filepath.Join(dir, "jobs.yaml"))
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"inherited_istio":  {"FILE_ONLY": "file", "OVERRIDDEN": "config", "key": "file"},
+		"overridden_istio": {"FILE_ONLY": "job", "OVERRIDDEN": "config", "key": "file"},
+	}
+	got := map[string]map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = map[string]string{}
+		for _, e := range p.Spec.Containers[0].Env {
+			got[p.Name][e.Name] = e.Value
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("env does not match, (-want, +got): \n%s", diff)
+	}
+
+	if _, err := parseEnvFile("bad.env", []byte("NOT_A_PAIR\n")); err == nil {
+		t.Fatal("expected an error for a malformed env file, but did not receive one")
+	}
+}
+
+func TestPresubmitContexts(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := cli.ReadJobsConfig("testdata/matrix.yaml")
+	for _, branch := range []string{"master", "release-1.10"} {
+		output, err := cli.ConvertJobConfig("matrix.yaml", jobs, branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The context of a presubmit defaults to its name.
+		want := []string{}
+		for _, p := range output.PresubmitsStatic["istio/istio"] {
+			want = append(want, p.Name)
+		}
+		if len(want) != 12 {
+			t.Fatalf("expected 12 presubmits from the matrix, got %d", len(want))
+		}
+		if diff := cmp.Diff(want, cli.PresubmitContexts(jobs, branch)); diff != "" {
+			t.Fatalf("presubmit contexts do not match for %s, (-want, +got): \n%s", branch, diff)
+		}
+	}
+}
+
+func TestBranchLabel(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.BranchLabel = "branch"
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: custom
+  types: [presubmit]
+  command: [make, test]
+  labels:
+    branch: custom
+`)
+	for _, branch := range []string{"master", "release-1.2"} {
+		output, err := cli.ConvertJobConfig("jobs.yaml", jobs, branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		presubmits := output.PresubmitsStatic["istio/istio"]
+		if got := presubmits[0].Labels["branch"]; got != branch {
+			t.Errorf("expected branch label %q, got %q", branch, got)
+		}
+		if got := presubmits[1].Labels["branch"]; got != "custom" {
+			t.Errorf("expected user-set branch label to be kept, got %q", got)
+		}
+	}
+}
+
+func TestPeriodicPrimaryRepo(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: extras-only
+  types: [periodic]
+  interval: 1h
+  command: [make, test]
+  repos: [istio/tools]
+- name: explicit-primary
+  types: [periodic]
+  interval: 1h
+  command: [make, test]
+  repos: [istio/tools, istio/istio@release-1.2]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"extras-only_istio_periodic":      {"istio/istio@master", "istio/tools@master"},
+		"explicit-primary_istio_periodic": {"istio/istio@release-1.2", "istio/tools@master"},
+	}
+	got := map[string][]string{}
+	for _, p := range output.Periodics {
+		for _, ref := range p.ExtraRefs {
+			got[p.Name] = append(got[p.Name], fmt.Sprintf("%s/%s@%s", ref.Org, ref.Repo, ref.BaseRef))
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("extra refs do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestPostsubmitSkipBranches(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: deploy
+  types: [presubmit, postsubmit]
+  command: [make, deploy]
+  postsubmit_skip_branches: [release-1.1, release-1.2]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"^release-1.1$", "^release-1.2$"}
+	if diff := cmp.Diff(want, output.PostsubmitsStatic["istio/istio"][0].SkipBranches); diff != "" {
+		t.Errorf("postsubmit skip branches do not match, (-want, +got): \n%s", diff)
+	}
+	if sb := output.PresubmitsStatic["istio/istio"][0].SkipBranches; len(sb) != 0 {
+		t.Errorf("expected presubmit to have no skip branches, got %v", sb)
+	}
+
+	jobs.Jobs[0].PostsubmitSkipBranches = []string{"release-(1.1"}
+	if _, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master"); err == nil {
+		t.Fatal("expected an error for a malformed skip branch, but did not receive one")
+	}
+}
+
+func TestTerminationGracePeriod(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+termination_grace_period_seconds: 30
+jobs:
+- name: inherited
+  types: [presubmit]
+  command: [make, test]
+- name: overridden
+  types: [presubmit]
+  command: [make, test]
+  termination_grace_period_seconds: 300
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{"inherited_istio": 30, "overridden_istio": 300}
+	got := map[string]int64{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = *p.Spec.TerminationGracePeriodSeconds
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("termination grace periods do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestMergeResourcePresets(t *testing.T) {
+	config := `org: istio
+repo: istio
+image: fooimage
+resources_presets:
+  default:
+    limits:
+      memory: 32Gi
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`
+	tests := []struct {
+		name      string
+		merge     bool
+		resources v1.ResourceRequirements
+	}{
+		{
+			name: "replace",
+			resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse("32Gi")},
+			},
+		},
+		{
+			name:  "merge",
+			merge: true,
+			resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse("3000m"),
+					v1.ResourceMemory: resource.MustParse("32Gi"),
+				},
+				Requests: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse("1000m"),
+					v1.ResourceMemory: resource.MustParse("3Gi"),
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := ReadBase(nil, "testdata/.base.yaml")
+			bc.MergeResourcePresets = tt.merge
+			cli := &Client{BaseConfig: bc}
+			jobs := readJobsConfig(t, cli, config)
+			output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := output.PresubmitsStatic["istio/istio"][0].Spec.Containers[0].Resources
+			if !equality.Semantic.DeepEqual(tt.resources, got) {
+				t.Fatalf("resources do not match, want %v, got %v", tt.resources, got)
+			}
+		})
+	}
+}
+
+func TestPodNetworking(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: host-network
+  types: [presubmit]
+  command: [make, test]
+  host_network: true
+- name: custom-dns
+  types: [presubmit]
+  command: [make, test]
+  dns_policy: None
+  dns_config:
+    nameservers: [8.8.8.8]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	presubmits := output.PresubmitsStatic["istio/istio"]
+	if !presubmits[0].Spec.HostNetwork {
+		t.Error("expected host network to be enabled")
+	}
+	if presubmits[1].Spec.HostNetwork {
+		t.Error("expected host network to be disabled")
+	}
+	if presubmits[1].Spec.DNSPolicy != v1.DNSNone {
+		t.Errorf("expected dns policy None, got %q", presubmits[1].Spec.DNSPolicy)
+	}
+	if diff := cmp.Diff(&v1.PodDNSConfig{Nameservers: []string{"8.8.8.8"}}, presubmits[1].Spec.DNSConfig); diff != "" {
+		t.Errorf("dns config does not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestContainerPorts(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: server
+  types: [presubmit]
+  command: [make, test]
+  ports:
+  - name: http
+    containerPort: 8080
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []v1.ContainerPort{{Name: "http", ContainerPort: 8080}}
+	if diff := cmp.Diff(want, output.PresubmitsStatic["istio/istio"][0].Spec.Containers[0].Ports); diff != "" {
+		t.Fatalf("ports do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestPriorityClassName(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.PriorityClassName = "low"
+	cli := &Client{BaseConfig: bc}
+	tests := []struct {
+		name   string
+		config string
+		want   map[string]string
+	}{
+		{
+			name: "global",
+			config: `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: inherited
+  types: [presubmit]
+  command: [make, test]
+`,
+			want: map[string]string{"inherited_istio": "low"},
+		},
+		{
+			name: "file and job",
+			config: `org: istio
+repo: istio
+image: fooimage
+priority_class_name: medium
+jobs:
+- name: inherited
+  types: [presubmit]
+  command: [make, test]
+- name: overridden
+  types: [presubmit]
+  command: [make, test]
+  priority_class_name: high
+`,
+			want: map[string]string{"inherited_istio": "medium", "overridden_istio": "high"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, tt.config)
+			output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, p := range output.PresubmitsStatic["istio/istio"] {
+				got[p.Name] = p.Spec.PriorityClassName
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("priority classes do not match, (-want, +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterAliases(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.ClusterAliases = map[string]string{"build-trusted": "prow-trusted"}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: aliased
+  types: [presubmit]
+  command: [make, test]
+  cluster: build-trusted
+- name: direct
+  types: [presubmit]
+  command: [make, test]
+  cluster: prow-untrusted
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Cluster
+	}
+	want := map[string]string{"aliased_istio": "prow-trusted", "direct_istio": "prow-untrusted"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("clusters do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestGerritLabels(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: gerrit.istio
+repo: istio
+image: fooimage
+gerrit_presubmit_label: Verified
+gerrit_postsubmit_label: Verified
+jobs:
+- name: inherited
+  types: [presubmit, postsubmit]
+  command: [make, test]
+- name: overridden
+  types: [presubmit]
+  command: [make, test]
+  gerrit_presubmit_label: Presubmit-Verified
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["gerrit.istio/istio"] {
+		got[p.Name] = p.Labels[kube.GerritReportLabel]
+	}
+	for _, p := range output.PostsubmitsStatic["gerrit.istio/istio"] {
+		got[p.Name] = p.Labels[kube.GerritReportLabel]
+	}
+	want := map[string]string{
+		"inherited_istio":            "Verified",
+		"inherited_istio_postsubmit": "Verified",
+		"overridden_istio":           "Presubmit-Verified",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("gerrit labels do not match, (-want, +got): \n%s", diff)
+	}
+	if contexts := cli.PresubmitContexts(jobs, "master"); len(contexts) != 0 {
+		t.Errorf("expected no GitHub contexts for Gerrit jobs, got %v", contexts)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: nightly
+  types: [periodic]
+  command: [make, test]
+  cron: "0 4 * * *"
+  jitter: 30m
+- name: hourly
+  types: [periodic]
+  command: [make, test]
+  cron: "0 * * * *"
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.Periodics {
+		got[p.Name] = p.Cron
+	}
+	want := map[string]string{
+		"nightly_istio_periodic": applyJitter("0 4 * * *", "nightly_istio_periodic", "30m"),
+		"hourly_istio_periodic":  "0 * * * *",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("crons do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestApplyJitter(t *testing.T) {
+	for _, name := range []string{"a", "b", "c", "nightly_istio_periodic"} {
+		got := applyJitter("50 4 * * *", name, "20m")
+		if got != applyJitter("50 4 * * *", name, "20m") {
+			t.Fatalf("expected the jitter of %s to be stable", name)
+		}
+		var hour, minute int
+		if _, err := fmt.Sscanf(got, "%d %d * * *", &minute, &hour); err != nil {
+			t.Fatalf("unexpected cron %q: %v", got, err)
+		}
+		// The minutes past the hour are carried into the hour.
+		if delay := hour*60 + minute - (4*60 + 50); delay < 0 || delay >= 20 {
+			t.Errorf("expected %s to be delayed by less than 20m from 50 4 * * *, got %q", name, got)
+		}
+	}
+	if got := applyJitter("*/5 * * * *", "a", "20m"); got != "*/5 * * * *" {
+		t.Errorf("expected a cron without a single minute to be unchanged, got %q", got)
+	}
+}
+
+func TestDelayCron(t *testing.T) {
+	tests := []struct {
+		cron    string
+		minutes int
+		want    string
+	}{
+		{cron: "10 4 * * *", minutes: 20, want: "30 4 * * *"},
+		{cron: "50 4 * * *", minutes: 20, want: "10 5 * * *"},
+		{cron: "50 23 * * *", minutes: 20, want: "10 0 * * *"},
+		{cron: "50 * * * *", minutes: 20, want: "10 * * * *"},
+		{cron: "50 4 * * 1", minutes: 20, want: "10 5 * * 1"},
+		{cron: "50 23 * * 1", minutes: 20},
+		{cron: "50 * * * 1", minutes: 20},
+		{cron: "50 4,16 * * *", minutes: 20},
+		{cron: "*/5 * * * *", minutes: 20},
+	}
+	for _, tt := range tests {
+		got, err := delayCron(tt.cron, tt.minutes)
+		if (err != nil) != (tt.want == "") {
+			t.Errorf("%q: expected error %v, got %v", tt.cron, tt.want == "", err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.cron, tt.want, got)
+		}
+	}
+}
+
+func TestImagePullPolicy(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: tagged
+  types: [presubmit]
+  command: [make, test]
+- name: latest
+  types: [presubmit]
+  command: [make, test]
+  image: fooimage:latest
+- name: untagged
+  types: [presubmit]
+  command: [make, test]
+  image: fooimage
+- name: explicit
+  types: [presubmit]
+  command: [make, test]
+  image: fooimage:latest
+  image_pull_policy: IfNotPresent
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]v1.PullPolicy{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.Containers[0].ImagePullPolicy
+	}
+	want := map[string]v1.PullPolicy{
+		"tagged_istio":   "",
+		"latest_istio":   v1.PullAlways,
+		"untagged_istio": v1.PullAlways,
+		"explicit_istio": v1.PullIfNotPresent,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("image pull policies do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.DefaultBranch = "main"
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  types: [presubmit, postsubmit]
+  command: [make, test]
+`)
+	if diff := cmp.Diff([]string{"main"}, jobs.Branches); diff != "" {
+		t.Fatalf("branches do not match, (-want, +got): \n%s", diff)
+	}
+	tests := []struct {
+		branch string
+		want   map[string]string
+	}{
+		{
+			branch: "main",
+			want: map[string]string{
+				"unit_istio":            "istio_istio",
+				"unit_istio_postsubmit": "istio_istio_postsubmit",
+			},
+		},
+		{
+			branch: "release-1.0",
+			want: map[string]string{
+				"unit_istio_release-1.0":            "istio_release-1.0_istio",
+				"unit_istio_release-1.0_postsubmit": "istio_release-1.0_istio_postsubmit",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.branch, func(t *testing.T) {
+			output, err := cli.ConvertJobConfig("jobs.yaml", jobs, tt.branch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, p := range output.PresubmitsStatic["istio/istio"] {
+				got[p.Name] = p.Annotations[TestGridDashboard]
+			}
+			for _, p := range output.PostsubmitsStatic["istio/istio"] {
+				got[p.Name] = p.Annotations[TestGridDashboard]
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("job names and dashboards do not match, (-want, +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunBeforeMerge(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: expensive
+  types: [presubmit]
+  command: [make, test]
+  run_before_merge: true
+- name: cheap
+  types: [presubmit]
+  command: [make, test]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type gating struct{ AlwaysRun, RunBeforeMerge bool }
+	got := map[string]gating{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = gating{p.AlwaysRun, p.RunBeforeMerge}
+	}
+	want := map[string]gating{
+		"expensive_istio": {AlwaysRun: false, RunBeforeMerge: true},
+		"cheap_istio":     {AlwaysRun: true, RunBeforeMerge: false},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("presubmits do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestConvertJobConfigForBranches(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: other
+repo: repo
+image: fooimage
+branches: [master, release-1.0]
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`)
+	outputs, err := cli.ConvertJobConfigForBranches("jobs.yaml", jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for branch, output := range outputs {
+		for _, p := range output.PresubmitsStatic["other/repo"] {
+			got[branch] = p.Name
+		}
+	}
+	want := map[string]string{"master": "unit_repo", "release-1.0": "unit_repo_release-1.0"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("job names do not match, (-want, +got): \n%s", diff)
+	}
+
+	// unit on branch b_repo and unit_repo_b on master are both named
+	// unit_repo_b_repo.
+	jobs = readJobsConfig(t, cli, `org: other
+repo: repo
+image: fooimage
+branches: [master, b_repo]
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: unit_repo_b
+  types: [presubmit]
+  command: [make, test]
+`)
+	if _, err := cli.ConvertJobConfigForBranches("jobs.yaml", jobs); err == nil {
+		t.Fatal("expected an error for the job name generated for both branches, but did not receive one")
+	}
+}
+
+func TestRequirementSidecars(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+requirement_presets:
+  local-registry:
+    env:
+    - name: REGISTRY
+      value: localhost:5000
+    podSpec:
+      containers:
+      - name: registry
+        image: registry:2
+jobs:
+- name: plain
+  types: [presubmit]
+  command: [make, test]
+- name: registry
+  types: [presubmit]
+  command: [make, test]
+  requirements: [local-registry]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := map[string][]v1.Container{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		containers[p.Name] = p.Spec.Containers
+	}
+	got := containers["registry_istio"]
+	if len(got) != 2 {
+		t.Fatalf("expected the sidecar to be appended, got %+v", got)
+	}
+	if diff := cmp.Diff(v1.Container{Name: "registry", Image: "registry:2"}, got[1]); diff != "" {
+		t.Errorf("sidecars do not match, (-want, +got): \n%s", diff)
+	}
+	want := containers["plain_istio"][0]
+	want.Env = append(want.Env, v1.EnvVar{Name: "REGISTRY", Value: "localhost:5000"})
+	if diff := cmp.Diff(want, got[0]); diff != "" {
+		t.Errorf("main containers do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestTypeImage(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:pr
+jobs:
+- name: unit
+  types: [presubmit, postsubmit, periodic]
+  command: [make, test]
+  interval: 24h
+  periodic_image: fooimage:nightly
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.Containers[0].Image
+	}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.Containers[0].Image
+	}
+	for _, p := range output.Periodics {
+		got[p.Name] = p.Spec.Containers[0].Image
+	}
+	want := map[string]string{
+		"unit_istio":            "fooimage:pr",
+		"unit_istio_postsubmit": "fooimage:pr",
+		"unit_istio_periodic":   "fooimage:nightly",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("images do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestNormalizeInterval(t *testing.T) {
+	tests := map[string]string{
+		"60m":    "1h",
+		"24h":    "24h",
+		"90m":    "1h30m",
+		"1h0m0s": "1h",
+		"45s":    "45s",
+		"2m30s":  "2m30s",
+	}
+	for interval, want := range tests {
+		if got := normalizeInterval(interval); got != want {
+			t.Errorf("normalizeInterval(%q): expected %q, got %q", interval, want, got)
+		}
+	}
+
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: hourly
+  types: [periodic]
+  command: [make, test]
+  interval: 60m
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := output.Periodics[0].Interval; got != "1h" {
+		t.Errorf("expected the interval to be normalized to 1h, got %q", got)
+	}
+
+	jobs.Jobs[0].Interval = "every hour"
+	if _, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master"); err == nil {
+		t.Fatal("expected an error for an invalid interval, but did not receive one")
+	}
+}
+
+func TestProtectedMetadata(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.Labels = map[string]string{"cost-center": "testing", "team": "eng"}
+	bc.Annotations = map[string]string{"owner": "infra"}
+	bc.ProtectedLabels = []string{"cost-center"}
+	bc.ProtectedAnnotations = []string{"owner"}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+  labels:
+    cost-center: free
+    team: docs
+  annotations:
+    owner: me
+`)
+	res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+	if len(res.Warnings) != 2 {
+		t.Errorf("expected a warning for each protected key, got %v", res.Warnings)
+	}
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := output.PresubmitsStatic["istio/istio"][0]
+	if got := p.Labels["cost-center"]; got != "testing" {
+		t.Errorf("expected the protected label to keep the base value, got %q", got)
+	}
+	if got := p.Labels["team"]; got != "docs" {
+		t.Errorf("expected the unprotected label to be overridden, got %q", got)
+	}
+	if got := p.Annotations["owner"]; got != "infra" {
+		t.Errorf("expected the protected annotation to keep the base value, got %q", got)
+	}
+}
+
+func TestInlineVolumes(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  volumes:
+  - name: scratch
+    emptyDir: {}
+  volumeMounts:
+  - name: scratch
+    mountPath: /scratch
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The volumes of the job come before the ones from the default requirements.
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		if diff := cmp.Diff(v1.Volume{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}, p.Spec.Volumes[0]); diff != "" {
+			t.Errorf("volumes do not match, (-want, +got): \n%s", diff)
+		}
+		if diff := cmp.Diff(v1.VolumeMount{Name: "scratch", MountPath: "/scratch"}, p.Spec.Containers[0].VolumeMounts[0]); diff != "" {
+			t.Errorf("volume mounts do not match, (-want, +got): \n%s", diff)
+		}
+	}
+}
+
+func TestTopologySpreadConstraints(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: heavy
+  types: [periodic]
+  command: [make, test]
+  interval: 24h
+  topology_spread_constraints:
+  - maxSkew: 1
+    topologyKey: cloud.google.com/gke-nodepool
+    whenUnsatisfiable: DoNotSchedule
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []v1.TopologySpreadConstraint{{
+		MaxSkew:           1,
+		TopologyKey:       "cloud.google.com/gke-nodepool",
+		WhenUnsatisfiable: v1.DoNotSchedule,
+	}}
+	if diff := cmp.Diff(want, output.Periodics[0].Spec.TopologySpreadConstraints); diff != "" {
+		t.Fatalf("topology spread constraints do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestTriggerLabel(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: preview
+  types: [presubmit]
+  command: [make, preview]
+  trigger_label: needs-preview
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := output.PresubmitsStatic["istio/istio"][0]
+	if p.AlwaysRun || !p.Optional {
+		t.Errorf("expected the presubmit to be optional and not always run, got always_run=%v optional=%v", p.AlwaysRun, p.Optional)
+	}
+	if got := p.Annotations[TriggerLabelAnnotation]; got != "needs-preview" {
+		t.Errorf("expected the trigger label annotation to be needs-preview, got %q", got)
+	}
+}
+
+func TestReferencedImages(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	istio := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  version: ["1.24", "1.25"]
+requirement_presets:
+  local-registry:
+    podSpec:
+      containers:
+      - name: registry
+        image: registry:2
+jobs:
+- name: unit-$(matrix.version)
+  command: [make, test]
+  image: kindest/node:v$(matrix.version)
+  requirements: [local-registry]
+- name: lint
+  command: [make, lint]
+`)
+	// The image of the file is not run, since the only job overrides it.
+	tools := readJobsConfig(t, cli, `org: istio
+repo: tools
+image: toolsimage:1.0
+jobs:
+- name: nightly
+  types: [periodic]
+  command: [make, test]
+  interval: 24h
+  periodic_image: fooimage:nightly
+`)
+	want := []string{"fooimage:1.0", "fooimage:nightly", "kindest/node:v1.24", "kindest/node:v1.25", "registry:2"}
+	if diff := cmp.Diff(want, cli.ReferencedImages([]spec.JobsConfig{istio, tools})); diff != "" {
+		t.Fatalf("images do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestContextGroup(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  version: ["1.24", "1.25"]
+  mode: [ipv4, ipv6]
+jobs:
+- name: e2e-$(matrix.version)-$(matrix.mode)
+  types: [presubmit]
+  command: [make, e2e]
+  context_group: e2e-$(matrix.version)
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Context
+	}
+	want := map[string]string{
+		"e2e-1.24-ipv4_istio": "e2e-1.24/e2e-1.24-ipv4_istio",
+		"e2e-1.24-ipv6_istio": "e2e-1.24/e2e-1.24-ipv6_istio",
+		"e2e-1.25-ipv4_istio": "e2e-1.25/e2e-1.25-ipv4_istio",
+		"e2e-1.25-ipv6_istio": "e2e-1.25/e2e-1.25-ipv6_istio",
+		"unit_istio":          "",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("contexts do not match, (-want, +got): \n%s", diff)
+	}
+	contexts := cli.PresubmitContexts(jobs, "master")
+	sort.Strings(contexts)
+	wantContexts := []string{
+		"e2e-1.24/e2e-1.24-ipv4_istio", "e2e-1.24/e2e-1.24-ipv6_istio",
+		"e2e-1.25/e2e-1.25-ipv4_istio", "e2e-1.25/e2e-1.25-ipv6_istio", "unit_istio",
+	}
+	if diff := cmp.Diff(wantContexts, contexts); diff != "" {
+		t.Fatalf("presubmit contexts do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestProwJobDefaults(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.ProwJobDefaults = &prowjob.ProwJobDefault{TenantID: "istio"}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit, postsubmit, periodic]
+  command: [make, test]
+  interval: 24h
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &prowjob.ProwJobDefault{TenantID: "istio"}
+	for _, jb := range []config.JobBase{
+		output.PresubmitsStatic["istio/istio"][0].JobBase,
+		output.PostsubmitsStatic["istio/istio"][0].JobBase,
+		output.Periodics[0].JobBase,
+	} {
+		if diff := cmp.Diff(want, jb.ProwJobDefault); diff != "" {
+			t.Errorf("prowjob defaults of %s do not match, (-want, +got): \n%s", jb.Name, diff)
+		}
+	}
+	if err := ValidateGeneratedConfig(output); err != nil {
+		t.Fatal(err)
+	}
+
+	cli.BaseConfig.ProwJobDefaults = &prowjob.ProwJobDefault{}
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for prowjob_defaults without a tenant_id, but did not receive one")
+	}
+}
+
+func TestSSHKeySecrets(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+ssh_key_secrets: [ssh-secret]
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: private
+  types: [presubmit]
+  command: [make, test]
+  ssh_key_secrets: [private-ssh-secret]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"unit_istio":    {"ssh-secret"},
+		"private_istio": {"ssh-secret", "private-ssh-secret"},
+	}
+	got := map[string][]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		if p.DecorationConfig != nil {
+			got[p.Name] = p.DecorationConfig.SSHKeySecrets
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ssh key secrets do not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs.Jobs[0].SSHKeySecrets = []string{}
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for empty ssh_key_secrets, but did not receive one")
+	}
+}
+
+func TestGCSConfiguration(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [postsubmit]
+  command: [make, test]
+- name: artifacts
+  types: [postsubmit]
+  command: [make, test]
+  gcs_configuration:
+    bucket: istio-artifacts
+    path_strategy: single
+    default_org: istio
+    default_repo: istio
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*prowjob.GCSConfiguration{}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		if p.DecorationConfig != nil {
+			got[p.Name] = p.DecorationConfig.GCSConfiguration
+		} else {
+			got[p.Name] = nil
+		}
+	}
+	want := map[string]*prowjob.GCSConfiguration{
+		"unit_istio_postsubmit": nil,
+		"artifacts_istio_postsubmit": {
+			Bucket:       "istio-artifacts",
+			PathStrategy: "single",
+			DefaultOrg:   "istio",
+			DefaultRepo:  "istio",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("gcs configurations do not match, (-want, +got): \n%s", diff)
+	}
+
+	for _, strategy := range []string{"unknown", "legacy"} {
+		jobs.Jobs[1].GCSConfiguration = &prowjob.GCSConfiguration{Bucket: "istio-artifacts", PathStrategy: strategy}
+		if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+			t.Errorf("expected an error for path strategy %q, but did not receive one", strategy)
+		}
+	}
+}
+
+func TestVariantDivergence(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), Strict: true}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  env:
+  - name: JOB
+    value: $(job.name)
+- name: build
+  command: [make, build]
+  postsubmit_image: barimage:2.0
+`)
+	// Explicit overrides and the name of each job are not divergences.
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatalf("expected no warning for the jobs, got: %v", err)
+	}
+
+	presubmit := output.PresubmitsStatic["istio/istio"][0].JobBase
+	postsubmit := output.PostsubmitsStatic["istio/istio"][0].JobBase
+	if err := checkVariantDivergence(presubmit, postsubmit, jobs.Jobs[0]); err != nil {
+		t.Errorf("expected no divergence, got %v", err)
+	}
+	postsubmit.Spec = postsubmit.Spec.DeepCopy()
+	postsubmit.Spec.Containers[0].Image = "bazimage:1.0"
+	postsubmit.Spec.Containers[0].Args = []string{"-v"}
+	want := "the presubmit and postsubmit differ in spec.containers[0].args, spec.containers[0].image"
+	if err := checkVariantDivergence(presubmit, postsubmit, jobs.Jobs[0]); err == nil || err.Error() != want {
+		t.Errorf("expected error %q for the divergent jobs, got %v", want, err)
+	}
+	// The images overridden per type are not compared.
+	if err := checkVariantDivergence(presubmit, postsubmit, jobs.Jobs[1]); err == nil || strings.Contains(err.Error(), "image") {
+		t.Errorf("expected only the args to diverge for the job overriding its image, got %v", err)
+	}
+}
+
+func TestInheritedSchedule(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+interval: 6h
+jobs:
+- name: inherited
+  types: [periodic]
+  command: [make, test]
+- name: interval
+  types: [periodic]
+  command: [make, test]
+  interval: 1h
+- name: cron
+  types: [periodic]
+  command: [make, test]
+  cron: "0 4 * * *"
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type schedule struct{ Interval, Cron string }
+	got := map[string]schedule{}
+	for _, p := range output.Periodics {
+		got[p.Name] = schedule{p.Interval, p.Cron}
+	}
+	want := map[string]schedule{
+		"inherited_istio_periodic": {Interval: "6h"},
+		"interval_istio_periodic":  {Interval: "1h"},
+		"cron_istio_periodic":      {Cron: "0 4 * * *"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("schedules do not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs = readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+interval: 6h
+cron: "0 4 * * *"
+jobs:
+- name: inherited
+  types: [periodic]
+  command: [make, test]
+`)
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for the inherited interval and cron, but did not receive one")
+	}
+}
+
+func TestExplainRequirements(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+requirements: [gocache]
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+  requirements: [docker, github]
+  excluded_requirements: [gocache]
+`)
+	want := []string{"cache", "docker", "github"}
+	if diff := cmp.Diff(want, ExplainRequirements(jobs, "unit")); diff != "" {
+		t.Errorf("explained requirements do not match, (-want, +got): \n%s", diff)
+	}
+	if got := ExplainRequirements(jobs, "missing"); got != nil {
+		t.Errorf("expected no requirements for a missing job, got %v", got)
+	}
+
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each of the presets declares its own volume, so the volumes of the job
+	// show the presets that were applied.
+	var wantVolumes, gotVolumes []string
+	for _, req := range want {
+		for _, v := range jobs.RequirementPresets[req].Volumes {
+			wantVolumes = append(wantVolumes, v.Name)
+		}
+	}
+	for _, v := range output.PresubmitsStatic["istio/istio"][0].Spec.Volumes {
+		gotVolumes = append(gotVolumes, v.Name)
+	}
+	if diff := cmp.Diff(wantVolumes, gotVolumes); diff != "" {
+		t.Errorf("applied requirements do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestJobMetadata(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: proxy
+image: fooimage:1.0
+labels:
+  owner-of: $(job.repo)
+jobs:
+- name: unit
+  types: [postsubmit]
+  command: [make, test]
+  annotations:
+    description: $(job.name) for $(job.org)/$(job.repo) on $(job.branch)
+  env:
+  - name: JOB
+    value: $(job.name)
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "release-1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postsubmit := output.PostsubmitsStatic["istio/proxy"][0]
+	if got := postsubmit.Labels["owner-of"]; got != "proxy" {
+		t.Errorf("expected label owner-of to be proxy, got %q", got)
+	}
+	if got, want := postsubmit.Annotations["description"], "unit_proxy_release-1.1_postsubmit for istio/proxy on release-1.1"; got != want {
+		t.Errorf("expected annotation description to be %q, got %q", want, got)
+	}
+	if got := postsubmit.Spec.Containers[0].Env[0]; got.Value != postsubmit.Name {
+		t.Errorf("expected env %s to be %q, got %q", got.Name, postsubmit.Name, got.Value)
+	}
+
+	jobs.Jobs[0].Labels["team"] = "$(job.team)"
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for the unknown job metadata, but did not receive one")
+	}
+}
+
+func TestExcludedBranches(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+branches: [release-1.1, release-1.2]
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: feature
+  types: [presubmit]
+  command: [make, feature]
+  excluded_branches: [release-1.1]
+`)
+	outputs, err := cli.ConvertJobConfigForBranches("jobs.yaml", jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for branch, output := range outputs {
+		for _, p := range output.PresubmitsStatic["istio/istio"] {
+			got[branch] = append(got[branch], p.Name)
+		}
+	}
+	want := map[string][]string{
+		"release-1.1": {"unit_istio_release-1.1"},
+		"release-1.2": {"unit_istio_release-1.2", "feature_istio_release-1.2"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("generated jobs do not match, (-want, +got): \n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"unit_istio_release-1.1"}, cli.PresubmitContexts(jobs, "release-1.1")); diff != "" {
+		t.Errorf("presubmit contexts do not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs.Jobs[1].ExcludedBranches = []string{"release-1.0"}
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Warnings) == 0 {
+		t.Fatal("expected a warning for the unknown excluded branch, but did not receive one")
+	}
+}
+
+func TestIntervalFallback(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: sparse
+  types: [periodic]
+  command: [make, test]
+  cron: "0 4 * * 1"
+  interval: 48h
+  interval_fallback: true
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type schedule struct{ Interval, Cron string }
+	got := map[string]schedule{}
+	for _, p := range output.Periodics {
+		got[p.Name] = schedule{p.Interval, p.Cron}
+	}
+	want := map[string]schedule{
+		"sparse-cron_istio_periodic":     {Cron: "0 4 * * 1"},
+		"sparse-interval_istio_periodic": {Interval: "48h"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("periodics do not match, (-want, +got): \n%s", diff)
+	}
+	if err := ValidateGeneratedConfig(output); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs.Jobs[0].Interval = "2x"
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for the invalid interval, but did not receive one")
+	}
+	jobs.Jobs[0].Interval = ""
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for the missing interval, but did not receive one")
+	}
+}
+
+func TestNameSeparator(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.NameSeparator = "-"
+	bc.TestgridConfig.Enabled = true
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: proxy
+image: fooimage:1.0
+branches: [release-1.1]
+jobs:
+- name: unit_test
+  types: [presubmit, postsubmit, periodic]
+  command: [make, test]
+  interval: 24h
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "release-1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/proxy"] {
+		got[p.Name] = p.Annotations[TestGridDashboard]
+	}
+	for _, p := range output.PostsubmitsStatic["istio/proxy"] {
+		got[p.Name] = p.Annotations[TestGridDashboard]
+	}
+	for _, p := range output.Periodics {
+		got[p.Name] = p.Annotations[TestGridDashboard]
+	}
+	want := map[string]string{
+		"unit_test-proxy-release-1.1":            "istio-release-1.1-proxy",
+		"unit_test-proxy-release-1.1-postsubmit": "istio-release-1.1-proxy-postsubmit",
+		"unit_test-proxy-release-1.1-periodic":   "istio-release-1.1-proxy-periodic",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("job names and dashboards do not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs.Jobs[0].Name = "unit-test"
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for the job name containing the separator, but did not receive one")
+	}
+}
+
+func TestExcludedBaseRequirements(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.RequirementPresets["cache"] = spec.RequirementPreset{Env: []v1.EnvVar{{Name: "CACHE", Value: "true"}}}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+excluded_base_requirements: [cache]
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: cached
+  types: [presubmit]
+  command: [make, test]
+  requirements: [cache]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		for _, e := range p.Spec.Containers[0].Env {
+			if e.Name == "CACHE" {
+				got[p.Name] = true
+			}
+		}
+	}
+	if diff := cmp.Diff(map[string]bool{"cached_istio": true}, got); diff != "" {
+		t.Errorf("jobs with the cache requirement do not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs.ExcludedBaseRequirements = []string{"docker"}
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for excluding a requirement that is not a base requirement, but did not receive one")
+	}
+}
+
+func TestBuildJobBase(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+resources_presets:
+  large:
+    requests:
+      cpu: "8"
+      memory: 8Gi
+jobs:
+- name: unit
+  command: [make, test]
+  resources: large
+  requirements: [github]
+`)
+	jb, err := cli.BuildJobBase(jobs, jobs.Jobs[0], "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jb.Name != "unit_istio" {
+		t.Errorf("expected name unit_istio, got %s", jb.Name)
+	}
+	want := v1.ResourceRequirements{
+		Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("8"),
+			v1.ResourceMemory: resource.MustParse("8Gi"),
+		},
+	}
+	if got := jb.Spec.Containers[0].Resources; !equality.Semantic.DeepEqual(want, got) {
+		t.Errorf("resources do not match, want %v, got %v", want, got)
+	}
+	var volumes []string
+	for _, v := range jb.Spec.Volumes {
+		volumes = append(volumes, v.Name)
+	}
+	if diff := cmp.Diff([]string{"build-cache", "github"}, volumes); diff != "" {
+		t.Errorf("volumes of the requirements do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestConvertJobConfigFiltered(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+- name: e2e
+  types: [presubmit]
+  command: [make, e2e]
+`)
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name: "no filters",
+			want: []string{"unit_istio", "lint_istio", "e2e_istio"},
+		},
+		{
+			name:    "include",
+			include: []string{"unit", "e2e"},
+			want:    []string{"unit_istio", "e2e_istio"},
+		},
+		{
+			name:    "exclude",
+			exclude: []string{"lint"},
+			want:    []string{"unit_istio", "e2e_istio"},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"unit", "lint"},
+			exclude: []string{"lint"},
+			want:    []string{"unit_istio"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := cli.ConvertJobConfigFiltered("jobs.yaml", jobs, "master", tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range output.PresubmitsStatic["istio/istio"] {
+				got = append(got, p.Name)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("generated jobs do not match, (-want, +got): \n%s", diff)
+			}
+		})
+	}
+	if len(jobs.Jobs) != 3 {
+		t.Errorf("expected the jobs of the meta config to be left unchanged, got %d", len(jobs.Jobs))
+	}
+}
+
+func TestMatrixArch(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.ClusterOverrides = map[string]string{"arm64": "arm"}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  arch: [amd64, arm64]
+jobs:
+- name: build-$(matrix.arch)
+  types: [postsubmit]
+  command: [make, build]
+  node_selector:
+    kubernetes.io/arch: $(matrix.arch)
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type scheduling struct {
+		Arch, Cluster string
+	}
+	got := map[string]scheduling{}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = scheduling{p.Spec.NodeSelector["kubernetes.io/arch"], p.Cluster}
+	}
+	want := map[string]scheduling{
+		"build-amd64_istio_postsubmit": {Arch: "amd64"},
+		"build-arm64_istio_postsubmit": {Arch: "arm64", Cluster: "arm"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("scheduling of the jobs does not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestMatrixTolerations(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  arch: [amd64, arm64]
+jobs:
+- name: build-$(matrix.arch)
+  types: [postsubmit]
+  command: [make, build]
+  node_selector:
+    kubernetes.io/arch: $(matrix.arch)
+  tolerations:
+  - key: dedicated
+    value: build-$(matrix.arch)
+    effect: NoSchedule
+  - key: kubernetes.io/arch
+    operator: Equal
+    value: $(matrix.arch)
+    effect: NoSchedule
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]v1.Toleration{}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.Tolerations
+	}
+	archToleration := func(arch string) v1.Toleration {
+		return v1.Toleration{Key: "kubernetes.io/arch", Operator: v1.TolerationOpEqual, Value: arch, Effect: v1.TaintEffectNoSchedule}
+	}
+	want := map[string][]v1.Toleration{
+		"build-amd64_istio_postsubmit": {
+			{Key: "dedicated", Value: "build-amd64", Effect: v1.TaintEffectNoSchedule},
+			archToleration("amd64"),
+		},
+		// The arch toleration added for arm64 is not duplicated.
+		"build-arm64_istio_postsubmit": {
+			archToleration("arm64"),
+			{Key: "dedicated", Value: "build-arm64", Effect: v1.TaintEffectNoSchedule},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tolerations of the jobs do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestArchPinWithArchitectures(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+node_selector:
+  kubernetes.io/arch: amd64
+jobs:
+- name: build
+  types: [postsubmit]
+  command: [make, build]
+  architectures: [amd64, arm64]
+- name: test
+  types: [postsubmit]
+  command: [make, test]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.NodeSelector["kubernetes.io/arch"]
+	}
+	// The explicit architectures take precedence over the pinned arch.
+	want := map[string]string{
+		"build_istio_postsubmit":       "amd64",
+		"build-arm64_istio_postsubmit": "arm64",
+		"test_istio_postsubmit":        "amd64",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("archs of the jobs do not match, (-want, +got): \n%s", diff)
+	}
+	if err := ValidateGeneratedConfig(output); err != nil {
+		t.Errorf("expected the generated config to be valid, got %v", err)
+	}
+}
+
+func TestFallbackResources(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	delete(bc.ResourcePresets, "default")
+	bc.FallbackResources = &v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+	}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+resources_presets:
+  large:
+    requests:
+      cpu: "8"
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: large
+  types: [presubmit]
+  command: [make, test]
+  resources: large
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"unit_istio": "500m", "large_istio": "8"}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.Containers[0].Resources.Requests.Cpu().String()
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("cpu requests do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestPresetContainers(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.RequirementPresets["proxy"] = spec.RequirementPreset{
+		PodSpec: &v1.PodSpec{Containers: []v1.Container{{Name: "proxy", Image: "proxy:1.0"}}},
+	}
+	bc.RequirementPresets["main-env"] = spec.RequirementPreset{
+		Env:        []v1.EnvVar{{Name: "MAIN", Value: "true"}},
+		Containers: []string{"main"},
+	}
+	bc.RequirementPresets["proxy-env"] = spec.RequirementPreset{
+		Env:        []v1.EnvVar{{Name: "PROXY", Value: "true"}},
+		Containers: []string{"proxy"},
+	}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+  requirements: [proxy, main-env, proxy-env]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, c := range output.PresubmitsStatic["istio/istio"][0].Spec.Containers {
+		for _, e := range c.Env {
+			if e.Name == "MAIN" || e.Name == "PROXY" {
+				got[c.Name] = append(got[c.Name], e.Name)
+			}
+		}
+	}
+	want := map[string][]string{"": {"MAIN"}, "proxy": {"PROXY"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("container env do not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs.Jobs[0].Requirements = []string{"cache", "proxy-env"}
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for the unknown container proxy, but did not receive one")
+	}
+}
+
+func TestOverlays(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+cluster: default
+overlays:
+  prod:
+    cluster: prod-cluster
+  staging:
+    cluster: staging-cluster
+    gcs_log_bucket: staging-logs
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`)
+	got := map[string]string{}
+	for _, overlay := range []string{"prod", "staging"} {
+		output, err := cli.ConvertJobConfigWithOverlay("jobs.yaml", jobs, "master", overlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		presubmit := output.PresubmitsStatic["istio/istio"][0]
+		got[overlay] = presubmit.Cluster
+		if overlay == "staging" && presubmit.DecorationConfig.GCSConfiguration.Bucket != "staging-logs" {
+			t.Errorf("expected the staging overlay to set the bucket, got %v", presubmit.DecorationConfig.GCSConfiguration.Bucket)
+		}
+	}
+	if diff := cmp.Diff(map[string]string{"prod": "prod-cluster", "staging": "staging-cluster"}, got); diff != "" {
+		t.Errorf("clusters do not match, (-want, +got): \n%s", diff)
+	}
+	if jobs.Cluster != "default" || jobs.Jobs[0].Cluster != "default" {
+		t.Errorf("expected the meta config not to be modified, got cluster %s", jobs.Jobs[0].Cluster)
+	}
+
+	if _, err := cli.ConvertJobConfigWithOverlay("jobs.yaml", jobs, "master", "dev"); err == nil {
+		t.Error("expected an error for an unknown overlay, but did not receive one")
+	}
+}
+
+func TestExplicitReportingFields(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		name             string
+		job              string
+		expectOptional   bool
+		expectSkipReport bool
+		expectErr        bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:           "modifier",
+			job:            "modifiers: [presubmit_optional]",
+			expectOptional: true,
+		},
+		{
+			name:             "explicit fields",
+			job:              "optional: true\n  skip_report: true",
+			expectOptional:   true,
+			expectSkipReport: true,
+		},
+		{
+			name:             "explicit field augmenting modifiers",
+			job:              "modifiers: [presubmit_optional]\n  skip_report: true",
+			expectOptional:   true,
+			expectSkipReport: true,
+		},
+		{
+			name:      "contradicting optional",
+			job:       "modifiers: [presubmit_optional]\n  optional: false",
+			expectErr: true,
+		},
+		{
+			name:      "contradicting skip_report",
+			job:       "modifiers: [hidden]\n  skip_report: false",
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+  `+tt.job+"\n")
+			output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error for the contradicting fields, but did not receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			presubmit := output.PresubmitsStatic["istio/istio"][0]
+			if presubmit.Optional != tt.expectOptional || presubmit.SkipReport != tt.expectSkipReport {
+				t.Errorf("expected optional %v and skip_report %v, got %v and %v",
+					tt.expectOptional, tt.expectSkipReport, presubmit.Optional, presubmit.SkipReport)
 			}
 		})
 	}
 }
 
+func TestUnreachableBranch(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), Strict: true}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+branches: [master, release-1.2]
+jobs:
+- name: unit
+  types: [postsubmit]
+  command: [make, test]
+  postsubmit_skip_branches: [release-.*]
+`)
+	if _, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master"); err != nil {
+		t.Fatalf("expected no error for a branch that is not skipped, got %v", err)
+	}
+	_, err := cli.ConvertJobConfig("jobs.yaml", jobs, "release-1.2")
+	if err == nil || !strings.Contains(err.Error(), "postsubmit unit never runs, its branch settings exclude branch release-1.2") {
+		t.Fatalf("expected an error for the postsubmit that never runs, got %v", err)
+	}
+}
+
+func TestBeforeMerge(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: e2e
+  types: [presubmit]
+  command: [make, e2e]
+  before_merge: true
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	presubmit := output.PresubmitsStatic["istio/istio"][0]
+	if !presubmit.RunBeforeMerge || presubmit.AlwaysRun {
+		t.Errorf("expected the presubmit to only run before merge, got run_before_merge %v and always_run %v",
+			presubmit.RunBeforeMerge, presubmit.AlwaysRun)
+	}
+	if !presubmit.ContextRequired() {
+		t.Error("expected the status context of the presubmit to be required")
+	}
+	if err := ValidateGeneratedConfig(output); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"modifiers: [presubmit_optional]", "skip_report: true", "run_before_merge: false", "regex: '^docs/'"} {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: e2e
+  types: [presubmit]
+  command: [make, e2e]
+  before_merge: true
+  `+field+"\n")
+		if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) != 1 {
+			t.Errorf("expected one error for before_merge with %s, got %v", field, res.Errors)
+		}
+	}
+}
+
+func TestReadFS(t *testing.T) {
+	base, err := os.ReadFile("testdata/.base.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"configs/.base.yaml": {Data: base},
+		"configs/istio/jobs.yaml": {Data: []byte(`org: istio
+repo: istio
+image: fooimage:1.0
+env_file: common.env
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`)},
+		"configs/istio/common.env": {Data: []byte("KEY=value\n")},
+	}
+	bc, err := ReadBaseFS(fsys, nil, "configs/.base.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &Client{BaseConfig: bc}
+	fsJobs, err := cli.ReadJobsConfigFS(fsys, "configs/istio/jobs.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The jobs are read the same way from the disk.
+	dir := t.TempDir()
+	for _, name := range []string{"jobs.yaml", "common.env"} {
+		if err := os.WriteFile(filepath.Join(dir, name), fsys["configs/istio/"+name].Data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diskCli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	if diff := cmp.Diff(diskCli.ReadJobsConfig(filepath.Join(dir, "jobs.yaml")), fsJobs); diff != "" {
+		t.Errorf("jobs configs do not match, (-want, +got): \n%s", diff)
+	}
+	found := false
+	for _, e := range fsJobs.Jobs[0].Env {
+		found = found || (e.Name == "KEY" && e.Value == "value")
+	}
+	if !found {
+		t.Errorf("expected the env from the env file, got %v", fsJobs.Jobs[0].Env)
+	}
+
+	if _, err := cli.ReadJobsConfigFS(fsys, "configs/missing.yaml"); err == nil {
+		t.Error("expected an error for a missing file, but did not receive one")
+	}
+}
+
+func TestUploadIgnoresInterrupts(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: long
+  types: [presubmit]
+  command: [make, test]
+  upload_ignores_interrupts: true
+  grace_period: 15m
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	presubmits := output.PresubmitsStatic["istio/istio"]
+	if dc := presubmits[0].DecorationConfig; dc != nil && (dc.UploadIgnoresInterrupts != nil || dc.GracePeriod != nil) {
+		t.Errorf("expected the cluster defaults for unit, got %v and %v", dc.UploadIgnoresInterrupts, dc.GracePeriod)
+	}
+	dc := presubmits[1].DecorationConfig
+	if dc == nil || dc.UploadIgnoresInterrupts == nil || !*dc.UploadIgnoresInterrupts {
+		t.Fatalf("expected upload_ignores_interrupts to be set for long, got %v", dc)
+	}
+	if dc.GracePeriod == nil || dc.GracePeriod.Duration != 15*time.Minute {
+		t.Errorf("expected a grace period of 15m for long, got %v", dc.GracePeriod)
+	}
+}
+
+func TestSerialModifier(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: deploy
+  types: [presubmit, postsubmit, periodic]
+  interval: 24h
+  command: [make, deploy]
+  modifiers: [serial]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []int{
+		output.PresubmitsStatic["istio/istio"][0].MaxConcurrency,
+		output.PostsubmitsStatic["istio/istio"][0].MaxConcurrency,
+		output.Periodics[0].MaxConcurrency,
+	}
+	if diff := cmp.Diff([]int{1, 1, 1}, got); diff != "" {
+		t.Errorf("max concurrency does not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs.Jobs[0].MaxConcurrency = 5
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) != 1 {
+		t.Errorf("expected an error for the serial modifier with max_concurrency 5, got %v", res.Errors)
+	}
+}
+
+func TestInheritedChangeMatchers(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+skip_regex: '^docs/'
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+  skip_regex: '\.md$'
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		if p.AlwaysRun {
+			t.Errorf("expected presubmit %s not to always run", p.Name)
+		}
+		got[p.Name] = p.SkipIfOnlyChanged
+	}
+	if diff := cmp.Diff(map[string]string{"unit_istio": "^docs/", "lint_istio": `\.md$`}, got); diff != "" {
+		t.Errorf("change matchers do not match, (-want, +got): \n%s", diff)
+	}
+
+	// A job regex conflicts with the skip_regex inherited from the file.
+	jobs = readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+skip_regex: '^docs/'
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+  regex: '^pkg/'
+`)
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) != 1 {
+		t.Errorf("expected an error for the inherited skip_regex conflicting with regex, got %v", res.Errors)
+	}
+}
+
+func TestFileCluster(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+cluster: build-cluster
+jobs:
+- name: unit
+  types: [presubmit, postsubmit, periodic]
+  interval: 24h
+  command: [make, test]
+- name: trusted
+  types: [postsubmit]
+  command: [make, release]
+  cluster: trusted-cluster
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Cluster
+	}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Cluster
+	}
+	for _, p := range output.Periodics {
+		got[p.Name] = p.Cluster
+	}
+	want := map[string]string{
+		"unit_istio":               "build-cluster",
+		"unit_istio_postsubmit":    "build-cluster",
+		"unit_istio_periodic":      "build-cluster",
+		"trusted_istio_postsubmit": "trusted-cluster",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("clusters do not match, (-want, +got): \n%s", diff)
+	}
+
+	jobs.Cluster = DefaultCluster
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Warnings) != 1 {
+		t.Errorf("expected a warning for the file setting the default cluster, got %v", res.Warnings)
+	}
+	// The default cluster overrides the cluster of the base config.
+	cli.BaseConfig.Cluster = "base-cluster"
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Warnings) != 0 {
+		t.Errorf("expected no warnings for the default cluster overriding the base cluster, got %v", res.Warnings)
+	}
+}
+
+func TestPresetImagePullPolicy(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.RequirementPresets["always-pull"] = spec.RequirementPreset{ImagePullPolicy: v1.PullAlways}
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:dev
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+  requirements: [always-pull]
+- name: pinned
+  types: [presubmit]
+  command: [make, test]
+  requirements: [always-pull]
+  image_pull_policy: IfNotPresent
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]v1.PullPolicy{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.Containers[0].ImagePullPolicy
+	}
+	want := map[string]v1.PullPolicy{"unit_istio": v1.PullAlways, "pinned_istio": v1.PullIfNotPresent}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("image pull policies do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestMatrixLabels(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix_labels: true
+matrix:
+  os: [linux, windows]
+  version: ["1.24", "k8s/1.25+"]
+jobs:
+- name: e2e-$(matrix.os)-$(matrix.version)
+  types: [presubmit]
+  command: [make, e2e]
+  args: [--version=$(matrix.version)]
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = map[string]string{}
+		for _, k := range []string{"os", "version"} {
+			if v, ok := p.Labels[k]; ok {
+				got[p.Name][k] = v
+			}
+		}
+	}
+	want := map[string]map[string]string{
+		"e2e-linux-1.24_istio":        {"os": "linux", "version": "1.24"},
+		"e2e-linux-k8s/1.25+_istio":   {"os": "linux", "version": "k8s-1.25"},
+		"e2e-windows-1.24_istio":      {"os": "windows", "version": "1.24"},
+		"e2e-windows-k8s/1.25+_istio": {"os": "windows", "version": "k8s-1.25"},
+		"lint_istio":                  {},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("matrix labels do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestUniquePresubmitContexts(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  version: ["1.24", "1.25"]
+jobs:
+- name: e2e-$(matrix.version)
+  types: [presubmit]
+  command: [make, e2e]
+  context_group: e2e
+`)
+	if _, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The matrix expands both values into the same job, and so the same context.
+	jobs.Matrix["version"] = []string{"1.24", "1.24"}
+	_, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err == nil || !strings.Contains(err.Error(), "presubmits e2e-1.24_istio and e2e-1.24_istio have the same context e2e/e2e-1.24_istio") {
+		t.Fatalf("expected an error for the presubmits sharing a context, got %v", err)
+	}
+}
+
+func TestBaseEnv(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.Env = append(bc.Env, v1.EnvVar{Name: "OVERRIDDEN", Value: "base"})
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+env:
+- name: key
+  value: file
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+- name: overridden
+  types: [presubmit]
+  command: [make, test]
+  env:
+  - name: OVERRIDDEN
+    value: job
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = map[string]string{}
+		for _, e := range p.Spec.Containers[0].Env {
+			got[p.Name][e.Name] = e.Value
+		}
+	}
+	want := map[string]map[string]string{
+		"unit_istio":       {"OVERRIDDEN": "base", "key": "file"},
+		"overridden_istio": {"OVERRIDDEN": "job", "key": "file"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("env does not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestTeamAnnotation(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	cli.BaseConfig.TeamAnnotation = "testing.istio.io/team"
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+team: networking
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+  annotations:
+    description: unit tests
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+  team: tooling
+- name: e2e
+  types: [presubmit]
+  command: [make, e2e]
+  annotations:
+    testing.istio.io/team: release
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Annotations
+	}
+	if got := got["unit_istio"]["testing.istio.io/team"]; got != "networking" {
+		t.Errorf("expected unit_istio to be annotated with the team of the file, got %q", got)
+	}
+	if got := got["unit_istio"]["description"]; got != "unit tests" {
+		t.Errorf("expected unit_istio to keep its own annotations, got %q", got)
+	}
+	if got := got["lint_istio"]["testing.istio.io/team"]; got != "tooling" {
+		t.Errorf("expected lint_istio to be annotated with its own team, got %q", got)
+	}
+	if got := got["e2e_istio"]["testing.istio.io/team"]; got != "release" {
+		t.Errorf("expected the explicit annotation of e2e_istio to take precedence, got %q", got)
+	}
+
+	// No annotation is added without a key in the base config.
+	cli.BaseConfig.TeamAnnotation = ""
+	output, err = cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		if p.Name != "e2e_istio" && p.Annotations["testing.istio.io/team"] != "" {
+			t.Errorf("expected %s not to be annotated with its team, got %v", p.Name, p.Annotations)
+		}
+	}
+}
+
+func TestNormalizeJobsConfig(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobsConfig := cli.NormalizeJobsConfig(spec.JobsConfig{
+		Org:  "istio",
+		Repo: "istio",
+		CommonConfig: spec.CommonConfig{
+			Image: "fooimage:1.0",
+			Env:   []v1.EnvVar{{Name: "FILE", Value: "file"}},
+			ResourcePresets: map[string]v1.ResourceRequirements{
+				"small": {Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("100m")}},
+			},
+		},
+		Jobs: []spec.Job{{
+			Name:         "unit",
+			Command:      []string{"make", "test"},
+			CommonConfig: spec.CommonConfig{Requirements: []string{"kind"}},
+		}},
+	})
+
+	if diff := cmp.Diff([]string{"master"}, jobsConfig.Branches); diff != "" {
+		t.Errorf("branches do not match, (-want, +got): \n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"small"}, jobsConfig.FileResourcePresets); diff != "" {
+		t.Errorf("file resources presets do not match, (-want, +got): \n%s", diff)
+	}
+	if _, ok := jobsConfig.ResourcePresets["default"]; !ok {
+		t.Errorf("expected the default resources preset of the base config to be merged, got %v", jobsConfig.ResourcePresets)
+	}
+
+	job := jobsConfig.Jobs[0]
+	if diff := cmp.Diff([]v1.EnvVar{{Name: "key", Value: "value"}, {Name: "FILE", Value: "file"}}, job.Env); diff != "" {
+		t.Errorf("env does not match, (-want, +got): \n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"cache", "kind"}, job.Requirements); diff != "" {
+		t.Errorf("requirements do not match, (-want, +got): \n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"testing": "test-pool"}, job.NodeSelector); diff != "" {
+		t.Errorf("node selector does not match, (-want, +got): \n%s", diff)
+	}
+	if job.Image != "fooimage:1.0" {
+		t.Errorf("expected the job to inherit the image of the file, got %q", job.Image)
+	}
+}
+
+func TestReadJsonnet(t *testing.T) {
+	dir := t.TempDir()
+	jsonnetFile := filepath.Join(dir, "jobs.jsonnet")
+	jsonnet := `local job(name) = { name: name, types: ['presubmit'], command: ['make', name] };
+{ org: 'istio', repo: 'istio', image: 'fooimage:1.0', jobs: [job('test'), job('lint')] }
+`
+	// The evaluator prints the JSON a jsonnet evaluator outputs for the file.
+	evaluated := `{"image": "fooimage:1.0", "jobs": [{"command": ["make", "test"], "name": "test", "types": ["presubmit"]},
+{"command": ["make", "lint"], "name": "lint", "types": ["presubmit"]}], "org": "istio", "repo": "istio"}`
+	evaluator := filepath.Join(dir, "evaluator.sh")
+	files := map[string]string{
+		jsonnetFile:                     jsonnet,
+		filepath.Join(dir, "jobs.json"): evaluated,
+		evaluator:                       "#!/bin/sh\nexec cat \"${1%.jsonnet}.json\"\n",
+		filepath.Join(dir, "fail.sh"):   "#!/bin/sh\necho 'RUNTIME ERROR: field does not exist: nme' >&2\nexit 1\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), JsonnetCommand: evaluator}
+	want := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: test
+  types: [presubmit]
+  command: [make, test]
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+`)
+	if diff := cmp.Diff(want, cli.ReadJobsConfig(jsonnetFile)); diff != "" {
+		t.Errorf("jobs configs do not match, (-want, +got): \n%s", diff)
+	}
+
+	t.Run("jsonnet", func(t *testing.T) {
+		// The jsonnet files are evaluated with the jsonnet binary by default.
+		if _, err := exec.LookPath("jsonnet"); err != nil {
+			t.Skip("jsonnet is not installed")
+		}
+		cli := &Client{BaseConfig: cli.BaseConfig}
+		if diff := cmp.Diff(want, cli.ReadJobsConfig(jsonnetFile)); diff != "" {
+			t.Errorf("jobs configs do not match, (-want, +got): \n%s", diff)
+		}
+	})
+
+	cli.JsonnetCommand = filepath.Join(dir, "fail.sh")
+	_, err := cli.readJobsConfigFile(jsonnetFile)
+	if err == nil || !strings.Contains(err.Error(), "failed to evaluate "+jsonnetFile) ||
+		!strings.Contains(err.Error(), "RUNTIME ERROR: field does not exist: nme") {
+		t.Errorf("expected the error of the evaluator for the file, got %v", err)
+	}
+	cli.JsonnetCommand = filepath.Join(dir, "missing-jsonnet")
+	if _, err := cli.readJobsConfigFile(jsonnetFile); err == nil || !strings.Contains(err.Error(), jsonnetFile) {
+		t.Errorf("expected an error for the missing evaluator, got %v", err)
+	}
+
+	fsys := fstest.MapFS{"jobs.jsonnet": {Data: []byte(jsonnet)}}
+	if _, err := cli.ReadJobsConfigFS(fsys, "jobs.jsonnet"); err == nil {
+		t.Error("expected an error for a jsonnet file in a file system, but did not receive one")
+	}
+}
+
+func TestActiveDeadlineSeconds(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: e2e
+  types: [presubmit]
+  command: [make, e2e]
+  timeout: 2h
+  active_deadline_seconds: 9000
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*int64{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Spec.ActiveDeadlineSeconds
+	}
+	deadline := int64(9000)
+	want := map[string]*int64{"e2e_istio": &deadline, "unit_istio": nil}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("active deadlines do not match, (-want, +got): \n%s", diff)
+	}
+	if got := output.PresubmitsStatic["istio/istio"][0].DecorationConfig.Timeout.Duration; got != 2*time.Hour {
+		t.Errorf("expected the timeout to be kept, got %v", got)
+	}
+}
+
+func TestAlwaysRunOptionalPresubmit(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), Strict: true}
+	tests := map[string]bool{
+		"optional: true":                          true,
+		"modifiers: [presubmit_optional]":         true,
+		"optional: false":                         false,
+		"optional: true\n  regex: '^pilot/'":      false,
+		"optional: true\n  skip_regex: '^docs/'":  false,
+		"optional: true\n  types: [postsubmit]":   false,
+		"modifiers: [presubmit_optional, hidden]": true,
+	}
+	want := "presubmit unit_istio always runs but is optional"
+	for fields, expectWarning := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  `+fields+"\n")
+		_, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+		if got := err != nil && strings.Contains(err.Error(), want); got != expectWarning {
+			t.Errorf("%q: expected warning %v, got %v", fields, expectWarning, err)
+		}
+	}
+}
+
+func TestCloneURI(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+clone_uri: git@github.com:istio/istio.git
+jobs:
+- name: unit
+  types: [presubmit, postsubmit, periodic]
+  command: [make, test]
+  interval: 24h
+- name: mirror
+  types: [presubmit]
+  command: [make, test]
+  clone_uri: https://mirror.example.com/istio/istio.git
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.CloneURI
+	}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = p.CloneURI
+	}
+	for _, p := range output.Periodics {
+		got[p.Name] = p.ExtraRefs[0].CloneURI
+	}
+	want := map[string]string{
+		"unit_istio":            "git@github.com:istio/istio.git",
+		"unit_istio_postsubmit": "git@github.com:istio/istio.git",
+		"unit_istio_periodic":   "git@github.com:istio/istio.git",
+		"mirror_istio":          "https://mirror.example.com/istio/istio.git",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("clone URIs do not match, (-want, +got): \n%s", diff)
+	}
+
+	// The repo is cloned from GitHub by default.
+	jobs.CloneURI = ""
+	output, err = cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := output.PostsubmitsStatic["istio/istio"][0].CloneURI; got != "" {
+		t.Errorf("expected no clone URI by default, got %q", got)
+	}
+}
+
+func TestForbidPrivileged(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.ForbidPrivileged = true
+	bc.PrivilegedJobs = []string{"integ"}
+	cli := &Client{BaseConfig: bc}
+	meta := `org: istio
+repo: istio
+image: fooimage:1.0
+requirement_presets:
+  docker:
+    podSpec:
+      containers:
+      - name: dind
+        image: docker:dind
+        securityContext:
+          privileged: true
+jobs:
+- name: %s
+  types: [presubmit]
+  command: [make, test]
+  %s
+`
+	tests := []struct {
+		name, fields string
+		expectError  string
+	}{
+		{
+			name:        "unit",
+			expectError: "job unit_istio has the privileged containers main",
+		},
+		{
+			name:   "unit",
+			fields: "privileged: false",
+		},
+		{
+			name:        "unit",
+			fields:      "privileged: false\n  requirements: [docker]",
+			expectError: "job unit_istio has the privileged containers dind",
+		},
+		{
+			name:   "integ",
+			fields: "requirements: [docker]",
+		},
+	}
+	for _, tc := range tests {
+		jobs := readJobsConfig(t, cli, fmt.Sprintf(meta, tc.name, tc.fields))
+		_, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+		if tc.expectError == "" && err != nil {
+			t.Errorf("%s %q: expected no error, got %v", tc.name, tc.fields, err)
+		}
+		if tc.expectError != "" && (err == nil || !strings.Contains(err.Error(), tc.expectError)) {
+			t.Errorf("%s %q: expected error %q, got %v", tc.name, tc.fields, tc.expectError, err)
+		}
+	}
+}
+
+func TestDashboardGroup(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+dashboard_group: istio
+jobs:
+- name: unit
+  types: [presubmit, postsubmit, periodic]
+  command: [make, test]
+  interval: 24h
+- name: perf
+  types: [periodic]
+  command: [make, perf]
+  interval: 24h
+  dashboard_group: istio-perf
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range output.PresubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Annotations[TestGridDashboardGroup]
+	}
+	for _, p := range output.PostsubmitsStatic["istio/istio"] {
+		got[p.Name] = p.Annotations[TestGridDashboardGroup]
+	}
+	for _, p := range output.Periodics {
+		got[p.Name] = p.Annotations[TestGridDashboardGroup]
+	}
+	want := map[string]string{
+		"unit_istio":            "",
+		"unit_istio_postsubmit": "istio",
+		"unit_istio_periodic":   "istio",
+		"perf_istio_periodic":   "istio-perf",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("dashboard groups do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestOptionalBranches(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), Strict: true}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+branches: [master, feature/ambient]
+jobs:
+- name: integ
+  types: [presubmit]
+  command: [make, integ]
+  optional_branches: [feature/.*]
+`)
+	outputs, err := cli.ConvertJobConfigForBranches("jobs.yaml", jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type presubmit struct {
+		Branches []string
+		Optional bool
+	}
+	got := map[string]presubmit{}
+	for _, output := range outputs {
+		for _, p := range output.PresubmitsStatic["istio/istio"] {
+			got[p.Name] = presubmit{p.Branches, p.Optional}
+		}
+	}
+	want := map[string]presubmit{
+		"integ_istio":                 {Branches: []string{"^master$"}},
+		"integ_istio_feature/ambient": {Branches: []string{"^feature/ambient$"}, Optional: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("presubmits do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestWarningsLoggedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+branches: [master, release-1.0]
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  labels:
+    prow.k8s.io/type: presubmit
+`)
+	if _, err := cli.ConvertJobConfigForBranches("jobs.yaml", jobs); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "sets label prow.k8s.io/type"); n != 1 {
+		t.Errorf("expected the warning to be logged once for the file, got %d times:\n%s", n, buf.String())
+	}
+}
+
 func TestFilterReleaseBranchingJobs(t *testing.T) {
 	testCases := []struct {
 		name         string
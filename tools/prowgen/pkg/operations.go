@@ -15,13 +15,20 @@
 package pkg
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/go-multierror"
+	yamlv3 "gopkg.in/yaml.v3"
 	"k8s.io/test-infra/prow/config"
 	"sigs.k8s.io/yaml"
 
@@ -38,50 +45,608 @@ func WriteJobsConfig(jobsConfig spec.JobsConfig, file string) error {
 	return ioutil.WriteFile(file, bytes, 0o644)
 }
 
-// Write will write the generated Prow jobs to the given file.
+// Write will write the generated Prow jobs to the given file as YAML.
 func Write(jobs config.JobConfig, fname, header string) error {
-	bs, err := yaml.Marshal(jobs)
+	return (&Client{}).Write(jobs, fname, header)
+}
+
+// Check will diff the generated YAML config and the current config file.
+func Check(jobs config.JobConfig, currentConfigFile string, header string) error {
+	return (&Client{}).Check(jobs, currentConfigFile, header)
+}
+
+// Marshal marshals the generated Prow jobs in the output format of the client,
+// with the autogen header. JSON cannot contain comments, so the header is
+// omitted for JSON.
+func (cli *Client) Marshal(jobs config.JobConfig, header string) ([]byte, error) {
+	switch cli.OutputFormat {
+	case "", OutputFormatYAML:
+		bs, err := yaml.Marshal(jobs)
+		if err != nil {
+			return nil, err
+		}
+		return withHeader(bs, header), nil
+	case OutputFormatOrderedYAML:
+		bs, err := marshalOrderedYAML(jobs)
+		if err != nil {
+			return nil, err
+		}
+		return withHeader(bs, header), nil
+	case OutputFormatJSON:
+		bs, err := json.MarshalIndent(jobs, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(bs, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", cli.OutputFormat)
+	}
+}
+
+// marshalOrderedYAML marshals the generated Prow jobs as YAML with the fields in
+// the order Prow declares them, rather than in alphabetical order, so related
+// fields stay together. The name of each job comes first and its pod spec last.
+func marshalOrderedYAML(jobs config.JobConfig) ([]byte, error) {
+	// JSON keeps the declaration order of the fields, and is valid YAML.
+	bs, err := json.Marshal(jobs)
+	if err != nil {
+		return nil, err
+	}
+	doc := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(bs, doc); err != nil {
+		return nil, err
+	}
+	resetStyle(doc)
+	if len(doc.Content) == 1 {
+		for _, jobs := range mappingValues(doc.Content[0]) {
+			switch jobs.Kind {
+			case yamlv3.MappingNode:
+				// Presubmits and postsubmits are keyed by repo.
+				for _, repoJobs := range mappingValues(jobs) {
+					for _, job := range repoJobs.Content {
+						orderJobFields(job)
+					}
+				}
+			case yamlv3.SequenceNode:
+				for _, job := range jobs.Content {
+					orderJobFields(job)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resetStyle drops the JSON quoting and flow style of the nodes, so they are
+// written in the plain YAML style.
+func resetStyle(n *yamlv3.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		resetStyle(c)
+	}
+}
+
+// mappingValues returns the value nodes of the mapping node.
+func mappingValues(n *yamlv3.Node) []*yamlv3.Node {
+	if n.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	values := make([]*yamlv3.Node, 0, len(n.Content)/2)
+	for i := 1; i < len(n.Content); i += 2 {
+		values = append(values, n.Content[i])
+	}
+	return values
+}
+
+// orderJobFields moves the name of the job to the front and its pod spec to
+// the back, keeping the order of the other fields.
+func orderJobFields(job *yamlv3.Node) {
+	if job.Kind != yamlv3.MappingNode {
+		return
+	}
+	var name, spec, rest []*yamlv3.Node
+	for i := 0; i+1 < len(job.Content); i += 2 {
+		pair := job.Content[i : i+2]
+		switch pair[0].Value {
+		case "name":
+			name = pair
+		case "spec":
+			spec = pair
+		default:
+			rest = append(rest, pair...)
+		}
+	}
+	content := make([]*yamlv3.Node, 0, len(job.Content))
+	content = append(content, name...)
+	content = append(content, rest...)
+	content = append(content, spec...)
+	job.Content = content
+}
+
+// Write will write the generated Prow jobs to the given file. An error is
+// returned if the file would exceed the budgets of the base config.
+func (cli *Client) Write(jobs config.JobConfig, fname, header string) error {
+	bs, err := cli.Marshal(jobs, header)
 	if err != nil {
-		log.Fatalf("Failed to marshal result: %v", err)
+		return fmt.Errorf("%s: failed to marshal result: %v", fname, err)
+	}
+	if err := cli.checkBudget(jobs, bs); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
 	}
 	dir := filepath.Dir(fname)
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		log.Fatalf("failed to create directory %q: %v", dir, err)
+		return fmt.Errorf("failed to create directory %q: %v", dir, err)
+	}
+	cli.InvalidateFile(fname)
+	return ioutil.WriteFile(fname, bs, 0o644)
+}
+
+// checkBudget returns an error if the generated config file exceeds the size or
+// the number of jobs budgeted by the base config.
+func (cli *Client) checkBudget(jobs config.JobConfig, bs []byte) error {
+	if max := cli.BaseConfig.MaxFileBytes; max > 0 && len(bs) > max {
+		return fmt.Errorf("generated config is %d bytes, over the budget of %d bytes", len(bs), max)
+	}
+	if max := cli.BaseConfig.MaxFileJobs; max > 0 {
+		count := len(jobs.Periodics)
+		for _, presubmits := range jobs.PresubmitsStatic {
+			count += len(presubmits)
+		}
+		for _, postsubmits := range jobs.PostsubmitsStatic {
+			count += len(postsubmits)
+		}
+		if count > max {
+			return fmt.Errorf("generated config has %d jobs, over the budget of %d jobs", count, max)
+		}
+	}
+	return nil
+}
+
+// withHeader prepends the autogen header to the generated config. An empty
+// header is replaced with the default one, and NoAutogenHeader omits it.
+func withHeader(bs []byte, header string) []byte {
+	if header == NoAutogenHeader {
+		return bs
 	}
 	if header == "" {
 		header = DefaultAutogenHeader
 	}
 	output := []byte(header + "\n")
-	output = append(output, bs...)
-	return ioutil.WriteFile(fname, output, 0o644)
+	return append(output, bs...)
 }
 
-// Check will diff the generated config file and the current config file.
-func Check(jobs config.JobConfig, currentConfigFile string, header string) error {
-	current, err := ioutil.ReadFile(currentConfigFile)
+// Check will diff the generated config file and the current config file. An
+// error is also returned if the generated file exceeds the budgets of the base
+// config.
+func (cli *Client) Check(jobs config.JobConfig, currentConfigFile string, header string) error {
+	bs, err := cli.Marshal(jobs, header)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %v", err)
+	}
+	if err := cli.checkBudget(jobs, bs); err != nil {
+		return fmt.Errorf("%s: %v", currentConfigFile, err)
+	}
+	diff, err := cli.diff(jobs, currentConfigFile, header)
+	if err != nil {
+		return err
+	}
+	if diff != "" {
+		if got, ok := cli.staleHeader(jobs, currentConfigFile); ok {
+			return fmt.Errorf("header mismatch in file %s, the jobs are up to date but the header is %q instead of %q",
+				currentConfigFile, got, string(withHeader(nil, header)))
+		}
+		// Report the changed fields of the jobs, and fall back to the diff of the
+		// files if the jobs are the same or the current file cannot be parsed.
+		if current, err := cli.readJobConfigFile(currentConfigFile); err == nil {
+			if diffs, err := ComputeDiff(current, jobs); err == nil && len(diffs) != 0 {
+				return fmt.Errorf("generated config is different from file %s\nChanged fields, file -> generated:\n%s",
+					currentConfigFile, FormatJobDiffs(diffs))
+			}
+		}
+		return fmt.Errorf("generated config is different from file %s\nWant(-), got(+):\n%s", currentConfigFile, diff)
+	}
+	return nil
+}
+
+// staleHeader returns the header of the current config file, and whether the
+// jobs in the file match the generated config so only the header differs.
+func (cli *Client) staleHeader(jobs config.JobConfig, currentConfigFile string) (string, bool) {
+	current, err := cli.readFile(currentConfigFile)
+	if err != nil {
+		return "", false
+	}
+	body, err := cli.Marshal(jobs, NoAutogenHeader)
+	if err != nil || !bytes.HasSuffix(current, body) {
+		return "", false
+	}
+	return string(current[:len(current)-len(body)]), true
+}
+
+// VerifyConfig generates the config of the meta config for the branch, and
+// compares its jobs to the committed config file. It returns the jobs that
+// differ, which is empty if the committed file is up to date. Only the jobs
+// are compared, so the header and the formatting of the file are ignored.
+func (cli *Client) VerifyConfig(jobsConfig spec.JobsConfig, branch, committedFile string) ([]JobDiff, error) {
+	jobs, err := cli.ConvertJobConfig(filepath.Base(committedFile), jobsConfig, branch)
+	if err != nil {
+		return nil, err
+	}
+	committed, err := cli.readJobConfigFile(committedFile)
+	if err != nil {
+		return nil, err
+	}
+	return ComputeDiff(committed, jobs)
+}
+
+// readJobConfigFile reads the Prow jobs of a generated config file.
+func (cli *Client) readJobConfigFile(file string) (config.JobConfig, error) {
+	var jobs config.JobConfig
+	bs, err := cli.readFile(file)
+	if err != nil {
+		return jobs, fmt.Errorf("failed to read current config for %s: %v", file, err)
+	}
+	if err := yaml.Unmarshal(bs, &jobs); err != nil {
+		return jobs, fmt.Errorf("failed to parse current config %s: %v", file, err)
+	}
+	return jobs, nil
+}
+
+// diff returns the diff between the generated config and the current config
+// file, or an empty string if they are the same.
+func (cli *Client) diff(jobs config.JobConfig, currentConfigFile string, header string) (string, error) {
+	current, err := cli.readFile(currentConfigFile)
 	if err != nil {
-		return fmt.Errorf("failed to read current config for %s: %v", currentConfigFile, err)
+		return "", fmt.Errorf("failed to read current config for %s: %v", currentConfigFile, err)
 	}
 
-	newConfig, err := yaml.Marshal(jobs)
+	output, err := cli.Marshal(jobs, header)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	return cmp.Diff(string(output), string(current)), nil
+}
+
+// readFile reads the file, or returns its cached content if CacheReads is set
+// and it has been read before.
+func (cli *Client) readFile(file string) ([]byte, error) {
+	if !cli.CacheReads {
+		return ioutil.ReadFile(file)
+	}
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if bs, ok := cli.files[file]; ok {
+		return bs, nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if cli.files == nil {
+		cli.files = map[string][]byte{}
+	}
+	cli.files[file] = bs
+	return bs, nil
+}
+
+// InvalidateFile drops the cached content of the file, so it is read again
+// the next time it is needed.
+func (cli *Client) InvalidateFile(file string) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	delete(cli.files, file)
+}
+
+// MergeJobConfigs merges the generated Prow jobs from two job configs. The
+// presubmits and postsubmits are merged per org/repo, and the periodics are
+// appended. An error is returned if the same job name is present in both, or
+// if two presubmits of the same org/repo have the same context.
+func MergeJobConfigs(a, b config.JobConfig) (config.JobConfig, error) {
+	merged := config.JobConfig{
+		PresubmitsStatic:  map[string][]config.Presubmit{},
+		PostsubmitsStatic: map[string][]config.Postsubmit{},
+		Periodics:         []config.Periodic{},
+	}
+	var err error
+	for _, jc := range []config.JobConfig{a, b} {
+		for orgRepo, presubmits := range jc.PresubmitsStatic {
+			for _, p := range presubmits {
+				for _, existing := range merged.PresubmitsStatic[orgRepo] {
+					if existing.Name == p.Name {
+						err = multierror.Append(err, fmt.Errorf("duplicate presubmit %s for %s", p.Name, orgRepo))
+					} else if githubContext(existing) == githubContext(p) {
+						err = multierror.Append(err, fmt.Errorf("presubmits %s and %s have the same context %s for %s",
+							existing.Name, p.Name, githubContext(p), orgRepo))
+					}
+				}
+				merged.PresubmitsStatic[orgRepo] = append(merged.PresubmitsStatic[orgRepo], p)
+			}
+		}
+		for orgRepo, postsubmits := range jc.PostsubmitsStatic {
+			for _, p := range postsubmits {
+				for _, existing := range merged.PostsubmitsStatic[orgRepo] {
+					if existing.Name == p.Name {
+						err = multierror.Append(err, fmt.Errorf("duplicate postsubmit %s for %s", p.Name, orgRepo))
+					}
+				}
+				merged.PostsubmitsStatic[orgRepo] = append(merged.PostsubmitsStatic[orgRepo], p)
+			}
+		}
+		for _, p := range jc.Periodics {
+			for _, existing := range merged.Periodics {
+				if existing.Name == p.Name {
+					err = multierror.Append(err, fmt.Errorf("duplicate periodic %s", p.Name))
+				}
+			}
+			merged.Periodics = append(merged.Periodics, p)
+		}
+	}
+	return merged, err
+}
+
+// OutputFileName returns the path of the generated config file for the
+// org/repo:branch under the output dir.
+func OutputFileName(outDir, org, repo, branch string) string {
+	return filepath.Join(outDir, org, repo, fmt.Sprintf("%s.%s.%s.gen.yaml", org, repo, branch))
+}
+
+// BranchOutputFileName returns the path of the generated config file for the
+// org/repo:branch in the directory of the branch under the output dir.
+func BranchOutputFileName(outDir, org, repo, branch string) string {
+	return filepath.Join(outDir, branch, fmt.Sprintf("%s-%s.yaml", org, repo))
+}
+
+// WriteBranches converts the meta config for each of its branches, and writes
+// the generated config of each branch to its own directory under the output
+// dir, as named by BranchOutputFileName.
+func (cli *Client) WriteBranches(fileName string, jobsConfig spec.JobsConfig, outDir string) error {
+	outputs, err := cli.ConvertJobConfigForBranches(fileName, jobsConfig)
+	if err != nil {
+		return err
+	}
+	for _, branch := range jobsConfig.Branches {
+		output := outputs[branch]
+		if err := ValidateGeneratedConfig(output); err != nil {
+			return fmt.Errorf("%s: branch %s: %v", fileName, branch, err)
+		}
+		fname := BranchOutputFileName(outDir, jobsConfig.Org, jobsConfig.Repo, branch)
+		if err := cli.Write(output, fname, cli.BaseConfig.AutogenHeader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateAll reads the base config once, converts the meta config files in
+// parallel, and writes the generated config for each org/repo:branch under the
+// output dir. Like the CLI, the .base.yaml in the directory of a meta config
+// file overlays the base config for the files in that directory. Jobs for the
+// same org/repo:branch are merged in the order of the given files, so the
+// output does not depend on the scheduling. The errors from all the files are
+// returned together, and do not prevent the other files from being written.
+func GenerateAll(baseFile string, jobFiles []string, outDir string) error {
+	bc, err := readBase(nil, baseFile, ioutil.ReadFile)
+	if err != nil {
+		return err
+	}
+	cli := &Client{BaseConfig: bc}
+	// The clients of the directories with their own base config, and the errors
+	// reading them.
+	dirClients := map[string]*Client{}
+	dirErrs := map[string]error{}
+	for _, file := range jobFiles {
+		dir := filepath.Dir(file)
+		dirBase := filepath.Join(dir, ".base.yaml")
+		if _, ok := dirClients[dir]; ok || dirErrs[dir] != nil || filepath.Clean(dirBase) == filepath.Clean(baseFile) {
+			continue
+		}
+		if _, e := os.Stat(dirBase); os.IsNotExist(e) {
+			continue
+		}
+		dirBC, e := readBase(&bc, dirBase, ioutil.ReadFile)
+		if e != nil {
+			dirErrs[dir] = e
+			continue
+		}
+		dirClients[dir] = &Client{BaseConfig: dirBC}
+	}
+
+	type result struct {
+		org, repo string
+		outputs   map[string]config.JobConfig
+		err       error
+	}
+	results := make([]result, len(jobFiles))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				dir := filepath.Dir(jobFiles[i])
+				if e := dirErrs[dir]; e != nil {
+					results[i] = result{err: fmt.Errorf("%s: %v", jobFiles[i], e)}
+					continue
+				}
+				fileCli := cli
+				if c, ok := dirClients[dir]; ok {
+					fileCli = c
+				}
+				jobs, err := fileCli.readJobsConfigFile(jobFiles[i])
+				if err != nil {
+					// The error already names the file.
+					results[i] = result{err: err}
+					continue
+				}
+				res := result{org: jobs.Org, repo: jobs.Repo}
+				res.outputs, res.err = fileCli.ConvertJobConfigForBranches(filepath.Base(jobFiles[i]), jobs)
+				if res.err != nil {
+					res.err = fmt.Errorf("%s: %v", jobFiles[i], res.err)
+				}
+				results[i] = res
+			}
+		}()
+	}
+	for i := range jobFiles {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	merged := map[string]config.JobConfig{}
+	for i, res := range results {
+		if res.err != nil {
+			err = multierror.Append(err, res.err)
+			continue
+		}
+		for branch, output := range res.outputs {
+			fname := OutputFileName(outDir, res.org, res.repo, branch)
+			if existing, ok := merged[fname]; ok {
+				m, e := MergeJobConfigs(existing, output)
+				if e != nil {
+					err = multierror.Append(err, fmt.Errorf("%s: %v", jobFiles[i], e))
+					continue
+				}
+				output = m
+			}
+			merged[fname] = output
+		}
+	}
+
+	fnames := make([]string, 0, len(merged))
+	for fname := range merged {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+	for _, fname := range fnames {
+		if e := ValidateGeneratedConfig(merged[fname]); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s: %v", fname, e))
+			continue
+		}
+		if e := cli.Write(merged[fname], fname, cli.BaseConfig.AutogenHeader); e != nil {
+			err = multierror.Append(err, e)
+		}
+	}
+	return err
+}
+
+// IndexEntry is the generated config file of an org/repo:branch, with the
+// number of jobs of each type in it.
+type IndexEntry struct {
+	Org         string `json:"org"`
+	Repo        string `json:"repo"`
+	Branch      string `json:"branch"`
+	File        string `json:"file"`
+	Presubmits  int    `json:"presubmits"`
+	Postsubmits int    `json:"postsubmits"`
+	Periodics   int    `json:"periodics"`
+}
+
+// ConfigRef is the org/repo:branch of a generated config file.
+type ConfigRef struct {
+	Org    string
+	Repo   string
+	Branch string
+}
+
+// GenerateIndex returns a YAML index of the generated configs of each
+// org/repo:branch, with their paths named by OutputFileName under the output
+// dir, ordered by org, repo and branch.
+func GenerateIndex(outDir string, results map[ConfigRef]config.JobConfig) ([]byte, error) {
+	index := make([]IndexEntry, 0, len(results))
+	for ref, jobs := range results {
+		entry := IndexEntry{
+			Org:       ref.Org,
+			Repo:      ref.Repo,
+			Branch:    ref.Branch,
+			File:      OutputFileName(outDir, ref.Org, ref.Repo, ref.Branch),
+			Periodics: len(jobs.Periodics),
+		}
+		for _, presubmits := range jobs.PresubmitsStatic {
+			entry.Presubmits += len(presubmits)
+		}
+		for _, postsubmits := range jobs.PostsubmitsStatic {
+			entry.Postsubmits += len(postsubmits)
+		}
+		index = append(index, entry)
+	}
+	sort.Slice(index, func(i, j int) bool {
+		a, b := index[i], index[j]
+		if a.Org != b.Org {
+			return a.Org < b.Org
+		}
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Branch < b.Branch
+	})
+	return yaml.Marshal(index)
+}
+
+// prowValidationConfig is a minimal Prow config that provides the decoration
+// defaults a real Prow deployment would supply, so the generated jobs can be
+// loaded by Prow's own config loader.
+const prowValidationConfig = `plank:
+  default_decoration_config_entries:
+  - config:
+      gcs_configuration:
+        bucket: prowgen-validation
+        path_strategy: explicit
+      utility_images:
+        clonerefs: clonerefs
+        entrypoint: entrypoint
+        initupload: initupload
+        sidecar: sidecar
+`
+
+// ValidateGeneratedConfig will run the generated Prow jobs through Prow's
+// config loader and validation, to catch the issues that cannot be detected
+// from the meta config files.
+func ValidateGeneratedConfig(jobs config.JobConfig) error {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bs, err := yaml.Marshal(jobs)
 	if err != nil {
 		return fmt.Errorf("failed to marshal result: %v", err)
 	}
-	if header == "" {
-		header = DefaultAutogenHeader
+	prowConfigFile := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(prowConfigFile, []byte(prowValidationConfig), 0o644); err != nil {
+		return err
+	}
+	jobConfigFile := filepath.Join(dir, "jobs.yaml")
+	if err := ioutil.WriteFile(jobConfigFile, bs, 0o644); err != nil {
+		return err
 	}
-	output := []byte(header + "\n")
-	output = append(output, newConfig...)
 
-	if diff := cmp.Diff(output, current); diff != "" {
-		return fmt.Errorf("generated config is different from file %s\nWant(-), got(+):\n%s", currentConfigFile, diff)
+	if _, err := config.Load(prowConfigFile, jobConfigFile, nil, ""); err != nil {
+		return fmt.Errorf("generated config failed Prow validation: %v", err)
 	}
 	return nil
 }
 
-// Print will print out the generated Prow jobs config.
+// Print will print out the generated Prow jobs config as YAML.
 func Print(jobs config.JobConfig) {
-	bs, err := yaml.Marshal(jobs)
+	(&Client{}).Print(jobs)
+}
+
+// Print prints the generated Prow jobs in the output format of the client.
+func (cli *Client) Print(jobs config.JobConfig) {
+	bs, err := cli.Marshal(jobs, NoAutogenHeader)
 	if err != nil {
 		log.Fatalf("Failed to write result: %v", err)
 	}
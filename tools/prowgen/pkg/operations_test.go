@@ -0,0 +1,595 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/test-infra/prow/config"
+	"sigs.k8s.io/yaml"
+)
+
+func TestNoAutogenHeader(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := cli.ReadJobsConfig("testdata/simple.yaml")
+	output, err := cli.ConvertJobConfig("simple.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "simple.gen.yaml")
+	if err := Write(output, file, NoAutogenHeader); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := yaml.Marshal(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != string(want) {
+		t.Fatalf("expected the output to only contain the config, got:\n%s", bs)
+	}
+	if err := Check(output, file, NoAutogenHeader); err != nil {
+		t.Fatalf("expected check to pass without a header, got %v", err)
+	}
+	if err := Check(output, file, ""); err == nil {
+		t.Fatal("expected check to fail with the default header, but it passed")
+	}
+
+	if err := Write(output, file, ""); err != nil {
+		t.Fatal(err)
+	}
+	bs, err = os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(bs), DefaultAutogenHeader+"\n") {
+		t.Fatalf("expected the default header, got:\n%s", bs)
+	}
+}
+
+func TestMergeJobConfigs(t *testing.T) {
+	presubmit := func(name string) config.Presubmit {
+		return config.Presubmit{JobBase: config.JobBase{Name: name}}
+	}
+	a := config.JobConfig{
+		PresubmitsStatic: map[string][]config.Presubmit{
+			"istio/istio": {presubmit("shared_istio")},
+		},
+		Periodics: []config.Periodic{{JobBase: config.JobBase{Name: "nightly"}}},
+	}
+	b := config.JobConfig{
+		PresubmitsStatic: map[string][]config.Presubmit{
+			"istio/istio": {presubmit("specific_istio")},
+			"istio/tools": {presubmit("lint_tools")},
+		},
+		PostsubmitsStatic: map[string][]config.Postsubmit{
+			"istio/istio": {{JobBase: config.JobBase{Name: "specific_istio_postsubmit"}}},
+		},
+	}
+
+	merged, err := MergeJobConfigs(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, p := range merged.PresubmitsStatic["istio/istio"] {
+		got = append(got, p.Name)
+	}
+	if want := []string{"shared_istio", "specific_istio"}; !cmp.Equal(want, got) {
+		t.Errorf("expected presubmits %v, got %v", want, got)
+	}
+	if len(merged.PresubmitsStatic["istio/tools"]) != 1 || len(merged.PostsubmitsStatic["istio/istio"]) != 1 ||
+		len(merged.Periodics) != 1 {
+		t.Errorf("expected all the jobs to be merged, got %+v", merged)
+	}
+	if len(a.PresubmitsStatic["istio/istio"]) != 1 {
+		t.Error("expected the inputs to not be modified")
+	}
+
+	b.PresubmitsStatic["istio/istio"] = append(b.PresubmitsStatic["istio/istio"], presubmit("shared_istio"))
+	if _, err := MergeJobConfigs(a, b); err == nil {
+		t.Fatal("expected an error for colliding job names, but did not receive one")
+	}
+
+	// The presubmits generated from two files cannot share a context.
+	c := config.JobConfig{PresubmitsStatic: map[string][]config.Presubmit{
+		"istio/istio": {{JobBase: config.JobBase{Name: "e2e_istio"}, Reporter: config.Reporter{Context: "e2e"}}},
+	}}
+	d := config.JobConfig{PresubmitsStatic: map[string][]config.Presubmit{
+		"istio/istio": {{JobBase: config.JobBase{Name: "e2e_istio_new"}, Reporter: config.Reporter{Context: "e2e"}}},
+		"istio/tools": {{JobBase: config.JobBase{Name: "e2e_tools"}, Reporter: config.Reporter{Context: "e2e"}}},
+	}}
+	_, err = MergeJobConfigs(c, d)
+	if err == nil || !strings.Contains(err.Error(), "presubmits e2e_istio and e2e_istio_new have the same context e2e for istio/istio") {
+		t.Fatalf("expected an error for the presubmits sharing a context, got %v", err)
+	}
+	if strings.Contains(err.Error(), "e2e_tools") {
+		t.Errorf("expected the presubmits of other repos to be allowed to share a context, got %v", err)
+	}
+}
+
+func TestGenerateAll(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"unit.yaml": `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`,
+		"lint.yaml": `org: istio
+repo: istio
+image: fooimage:1.0
+branches: [master, release-1.0]
+jobs:
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+`,
+		"broken.yaml": `org: istio
+repo: tools
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`,
+		"malformed.yaml": `org: istio
+repo: proxy
+jobs: [
+`,
+	}
+	jobFiles := []string{}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		jobFiles = append(jobFiles, file)
+	}
+	sort.Strings(jobFiles)
+
+	outDir := filepath.Join(dir, "out")
+	err := GenerateAll("testdata/.base.yaml", jobFiles, outDir)
+	if err == nil {
+		t.Fatal("expected an error for the broken files, but did not receive one")
+	}
+	for _, name := range []string{"broken.yaml", "malformed.yaml"} {
+		if !strings.Contains(err.Error(), filepath.Join(dir, name)) {
+			t.Errorf("expected an error for %s, got %v", name, err)
+		}
+	}
+
+	want := map[string][]string{
+		OutputFileName(outDir, "istio", "istio", "master"):      {"lint_istio", "unit_istio"},
+		OutputFileName(outDir, "istio", "istio", "release-1.0"): {"lint_istio_release-1.0"},
+	}
+	for fname, names := range want {
+		bs, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatalf("expected %s to be generated: %v", fname, err)
+		}
+		jc := config.JobConfig{}
+		if err := yaml.Unmarshal(bs, &jc); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, p := range jc.PresubmitsStatic["istio/istio"] {
+			got = append(got, p.Name)
+		}
+		if diff := cmp.Diff(names, got); diff != "" {
+			t.Errorf("jobs in %s do not match, (-want, +got): \n%s", fname, diff)
+		}
+	}
+	if _, err := os.Stat(OutputFileName(outDir, "istio", "tools", "master")); !os.IsNotExist(err) {
+		t.Errorf("expected no output for the broken file, got %v", err)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), OutputFormat: OutputFormatJSON}
+	jobs := cli.ReadJobsConfig("testdata/simple.yaml")
+	output, err := cli.ConvertJobConfig("simple.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "simple.gen.json")
+	if err := cli.Write(output, file, ""); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := config.JobConfig{}
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("expected valid JSON output, got %v:\n%s", err, bs)
+	}
+	// Compare the YAML of the configs, since they contain unexported fields.
+	want, err := yaml.Marshal(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotYAML, err := yaml.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(want), string(gotYAML)); diff != "" {
+		t.Fatalf("round-tripped config does not match, (-want, +got): \n%s", diff)
+	}
+	if err := cli.Check(output, file, ""); err != nil {
+		t.Fatalf("expected check to pass for the JSON output, got %v", err)
+	}
+
+	if _, err := (&Client{OutputFormat: "toml"}).Marshal(output, ""); err == nil {
+		t.Fatal("expected an error for an unsupported output format, but did not receive one")
+	}
+}
+
+func TestOrderedYAMLOutput(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), OutputFormat: OutputFormatOrderedYAML}
+	jobs := cli.ReadJobsConfig("testdata/simple.yaml")
+	output, err := cli.ConvertJobConfig("simple.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := cli.Marshal(output, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := config.JobConfig{}
+	if err := yaml.UnmarshalStrict(bs, &got); err != nil {
+		t.Fatalf("expected valid YAML output, got %v:\n%s", err, bs)
+	}
+	// Compare the YAML of the configs, since they contain unexported fields.
+	want, err := yaml.Marshal(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotYAML, err := yaml.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(want), string(gotYAML)); diff != "" {
+		t.Fatalf("round-tripped config does not match, (-want, +got): \n%s", diff)
+	}
+
+	// The name of each job comes first.
+	for _, presubmits := range output.PresubmitsStatic {
+		for _, p := range presubmits {
+			if !strings.Contains(string(bs), "- name: "+p.Name+"\n") {
+				t.Errorf("expected presubmit %s to start with its name:\n%s", p.Name, bs)
+			}
+		}
+	}
+}
+
+func TestCheckHeaderMismatch(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := cli.ReadJobsConfig("testdata/simple.yaml")
+	output, err := cli.ConvertJobConfig("simple.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "simple.gen.yaml")
+	if err := cli.Write(output, file, "# An old header."); err != nil {
+		t.Fatal(err)
+	}
+	err = cli.Check(output, file, "")
+	if err == nil || !strings.Contains(err.Error(), "header mismatch") {
+		t.Fatalf("expected a header mismatch, got %v", err)
+	}
+
+	output.PresubmitsStatic = nil
+	err = cli.Check(output, file, "")
+	if err == nil || strings.Contains(err.Error(), "header mismatch") {
+		t.Fatalf("expected the jobs to differ, got %v", err)
+	}
+}
+
+func TestWriteBranches(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: proxy
+image: fooimage:1.0
+branches: [master, release-1.2]
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`)
+	outDir := t.TempDir()
+	if err := cli.WriteBranches("jobs.yaml", jobs, outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	if err := filepath.Walk(outDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(outDir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"master/istio-proxy.yaml", "release-1.2/istio-proxy.yaml"}, files); diff != "" {
+		t.Fatalf("generated files do not match, (-want, +got): \n%s", diff)
+	}
+	for branch, name := range map[string]string{"master": "unit_proxy", "release-1.2": "unit_proxy_release-1.2"} {
+		bs, err := os.ReadFile(BranchOutputFileName(outDir, "istio", "proxy", branch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(bs), cli.BaseConfig.AutogenHeader+"\n") {
+			t.Errorf("expected the file of branch %s to start with the autogen header, got:\n%s", branch, bs)
+		}
+		if !strings.Contains(string(bs), "name: "+name+"\n") {
+			t.Errorf("expected the file of branch %s to contain job %s, got:\n%s", branch, name, bs)
+		}
+	}
+}
+
+func TestGenerateIndex(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio.io
+image: fooimage:1.0
+branches: [master, release-1.2]
+jobs:
+- name: unit
+  types: [presubmit, postsubmit]
+  command: [make, test]
+- name: lint
+  types: [presubmit]
+  command: [make, lint]
+- name: nightly
+  types: [periodic]
+  cron: "0 0 * * *"
+  command: [make, test]
+`)
+	outputs, err := cli.ConvertJobConfigForBranches("jobs.yaml", jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[ConfigRef]config.JobConfig{}
+	for branch, output := range outputs {
+		results[ConfigRef{Org: "istio", Repo: "istio.io", Branch: branch}] = output
+	}
+	results[ConfigRef{Org: "istio", Repo: "proxy", Branch: "master"}] = config.JobConfig{}
+	// The branch is not parsed back from the path of the file.
+	results[ConfigRef{Org: "istio", Repo: "proxy", Branch: "release/1.3"}] = config.JobConfig{}
+
+	bs, err := GenerateIndex("out", results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []IndexEntry
+	if err := yaml.Unmarshal(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []IndexEntry{
+		{
+			Org: "istio", Repo: "istio.io", Branch: "master", File: "out/istio/istio.io/istio.istio.io.master.gen.yaml",
+			Presubmits: 2, Postsubmits: 1, Periodics: 1,
+		},
+		{
+			Org: "istio", Repo: "istio.io", Branch: "release-1.2", File: "out/istio/istio.io/istio.istio.io.release-1.2.gen.yaml",
+			Presubmits: 2, Postsubmits: 1, Periodics: 1,
+		},
+		{Org: "istio", Repo: "proxy", Branch: "master", File: "out/istio/proxy/istio.proxy.master.gen.yaml"},
+		{Org: "istio", Repo: "proxy", Branch: "release/1.3", File: "out/istio/proxy/istio.proxy.release/1.3.gen.yaml"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("index does not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestSizeBudget(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  version: ["1.22", "1.23", "1.24", "1.25"]
+jobs:
+- name: e2e-$(matrix.version)
+  types: [presubmit]
+  command: [make, e2e]
+`)
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "jobs.gen.yaml")
+	if err := cli.Write(output, fname, NoAutogenHeader); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli.BaseConfig.MaxFileBytes = int(info.Size()) - 1
+	err = cli.Write(output, fname, NoAutogenHeader)
+	want := fmt.Sprintf("generated config is %d bytes, over the budget of %d bytes", info.Size(), info.Size()-1)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error %q for the file over the byte budget, got %v", want, err)
+	}
+	if err := cli.Check(output, fname, NoAutogenHeader); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error %q when checking the file over the byte budget, got %v", want, err)
+	}
+
+	cli.BaseConfig.MaxFileBytes = 0
+	cli.BaseConfig.MaxFileJobs = 3
+	if err := cli.Write(output, fname, NoAutogenHeader); err == nil || !strings.Contains(err.Error(), "4 jobs, over the budget of 3 jobs") {
+		t.Errorf("expected an error for the file over the job budget, got %v", err)
+	}
+}
+
+func TestCheckJobDiffs(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := cli.ReadJobsConfig("testdata/simple.yaml")
+	output, err := cli.ConvertJobConfig("simple.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "simple.gen.yaml")
+	if err := cli.Write(output, file, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs.Jobs[0].Command = append(jobs.Jobs[0].Command, "--drifted")
+	output, err = cli.ConvertJobConfig("simple.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cli.Check(output, file, "")
+	want := `spec.containers[0].command[1]: <unset> -> "--drifted"`
+	if err == nil || !strings.Contains(err.Error(), want) || strings.Contains(err.Error(), "Want(-), got(+)") {
+		t.Fatalf("expected the changed fields of the jobs to contain %q, got %v", want, err)
+	}
+}
+
+func TestGenerateAllBaseConfigs(t *testing.T) {
+	dir := t.TempDir()
+	subDir := filepath.Join(dir, "sub")
+	if err := os.MkdirAll(subDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	jobs := `org: istio
+repo: proxy
+image: fooimage:1.0
+jobs:
+- name: unit
+  types: [presubmit]
+  command: [make, test]
+`
+	file := filepath.Join(subDir, "proxy.yaml")
+	if err := os.WriteFile(file, []byte(jobs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(subDir, ".base.yaml"), []byte("cluster: sub-cluster\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The base config of the directory overlays the base config.
+	outDir := filepath.Join(dir, "out")
+	if err := GenerateAll("testdata/.base.yaml", []string{file}, outDir); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(OutputFileName(outDir, "istio", "proxy", "master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc := config.JobConfig{}
+	if err := yaml.Unmarshal(bs, &jc); err != nil {
+		t.Fatal(err)
+	}
+	if p := jc.PresubmitsStatic["istio/proxy"]; len(p) != 1 || p[0].Cluster != "sub-cluster" {
+		t.Errorf("expected the job to use the cluster of the directory base config, got %v", p)
+	}
+
+	// The errors of the base configs and of writing are returned.
+	if err := GenerateAll(filepath.Join(dir, "missing.yaml"), []string{file}, outDir); err == nil {
+		t.Error("expected an error for a missing base config, but did not receive one")
+	}
+	if err := os.WriteFile(filepath.Join(subDir, ".base.yaml"), []byte("unknown: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateAll("testdata/.base.yaml", []string{file}, outDir); err == nil || !strings.Contains(err.Error(), file) {
+		t.Errorf("expected an error for the file with a broken directory base config, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(subDir, ".base.yaml"), []byte("cluster: sub-cluster\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.WriteFile(blocked, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateAll("testdata/.base.yaml", []string{file}, blocked); err == nil {
+		t.Error("expected an error for an output dir that cannot be created, but did not receive one")
+	}
+}
+
+func TestVerifyConfig(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := cli.ReadJobsConfig("testdata/simple.yaml")
+
+	diffs, err := cli.VerifyConfig(jobs, "master", "testdata/simple.gen.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("expected the committed config to be up to date, got diffs %v", diffs)
+	}
+
+	jobs.Jobs[0].Command = append(jobs.Jobs[0].Command, "--drifted")
+	diffs, err = cli.VerifyConfig(jobs, "master", "testdata/simple.gen.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) == 0 {
+		t.Fatal("expected the committed config to be out of date")
+	}
+	want := FieldChange{Field: "spec.containers[0].command[1]", New: "--drifted"}
+	if diff := cmp.Diff(want, diffs[0].Changes[0]); diff != "" {
+		t.Errorf("changes do not match, (-want, +got): \n%s", diff)
+	}
+}
+
+func TestCacheReads(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml"), CacheReads: true}
+	jobs := cli.ReadJobsConfig("testdata/simple.yaml")
+	output, err := cli.ConvertJobConfig("simple.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "simple.gen.yaml")
+	if err := cli.Write(output, file, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Check(output, file, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached content is used until the file is invalidated.
+	if err := os.WriteFile(file, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Check(output, file, ""); err != nil {
+		t.Fatalf("expected the cached content to be checked, got %v", err)
+	}
+	cli.InvalidateFile(file)
+	if err := cli.Check(output, file, ""); err == nil {
+		t.Fatal("expected the file to be read again after it is invalidated, but check passed")
+	}
+}
@@ -31,10 +31,77 @@ type BaseConfig struct {
 
 	AutogenHeader string `json:"autogen_header,omitempty"`
 
+	// MergeResourcePresets makes a resource preset that is redefined in a lower
+	// layer overlay each of the inherited requests and limits, instead of
+	// replacing the inherited preset as a whole.
+	MergeResourcePresets bool `json:"merge_resources_presets,omitempty"`
+
 	PathAliases map[string]string `json:"path_aliases,omitempty"`
 
 	ClusterOverrides map[string]string `json:"cluster_overrides,omitempty"`
 
+	// ClusterAliases is a map of alias:cluster. A job whose cluster matches an
+	// alias will be scheduled to the cluster it maps to.
+	ClusterAliases map[string]string `json:"cluster_aliases,omitempty"`
+
+	// AllowedHostPaths is the list of host paths, and the paths under them, that
+	// hostPath volumes can use. Any host path is allowed if it is empty.
+	AllowedHostPaths []string `json:"allowed_host_paths,omitempty"`
+
+	// EntrypointImages is the list of images, without a tag or digest, that
+	// have a default entrypoint, so the jobs using them need args instead of a
+	// command.
+	EntrypointImages []string `json:"entrypoint_images,omitempty"`
+
+	// KnownClusters is the list of clusters the jobs can be scheduled to. Any
+	// cluster is allowed if it is empty.
+	KnownClusters []string `json:"known_clusters,omitempty"`
+
+	// ProtectedLabels and ProtectedAnnotations are the keys of the labels and
+	// annotations in this config that cannot be overridden by the jobs.
+	ProtectedLabels      []string `json:"protected_labels,omitempty"`
+	ProtectedAnnotations []string `json:"protected_annotations,omitempty"`
+
+	// DefaultBranch is the default branch of the repos, which defaults to
+	// master. Jobs for the default branch are not suffixed with the branch.
+	DefaultBranch string `json:"default_branch,omitempty"`
+
+	// NameSeparator joins the job name, repo, branch and type in the names of
+	// the generated jobs and their testgrid dashboards. Defaults to _.
+	NameSeparator string `json:"name_separator,omitempty"`
+
+	// ForbidPrivileged makes the generation fail for the jobs with a privileged
+	// container, e.g. for a locked-down cluster, unless they are in
+	// PrivilegedJobs, the names of the jobs that are allowed to be privileged.
+	ForbidPrivileged bool     `json:"forbid_privileged,omitempty"`
+	PrivilegedJobs   []string `json:"privileged_jobs,omitempty"`
+
+	// MaxFileBytes and MaxFileJobs are the budgets of the size in bytes and the
+	// number of jobs of each generated config file, which guard against matrix
+	// explosions. They are not enforced when unset.
+	MaxFileBytes int `json:"max_file_bytes,omitempty"`
+	MaxFileJobs  int `json:"max_file_jobs,omitempty"`
+
+	// MaxTimeout is the maximum timeout of the jobs. Defaults to 24h.
+	MaxTimeout *prowjob.Duration `json:"max_timeout,omitempty"`
+
+	// BranchLabel is the key of the label that will be added to all the jobs,
+	// with the branch of the job as its value.
+	BranchLabel string `json:"branch_label,omitempty"`
+
+	// TeamAnnotation is the key of the annotation that will be added to all the
+	// jobs of a file that sets a team, with the team as its value, e.g. to
+	// route the failures of the jobs to their owners.
+	TeamAnnotation string `json:"team_annotation,omitempty"`
+
+	// FallbackResources are the resources of the jobs that neither set a
+	// resources preset nor have a default one.
+	FallbackResources *v1.ResourceRequirements `json:"fallback_resources,omitempty"`
+
+	// ProwJobDefaults are the Prow job defaults, e.g. the tenant ID, that will be
+	// set on all the jobs.
+	ProwJobDefaults *prowjob.ProwJobDefault `json:"prowjob_defaults,omitempty"`
+
 	TestgridConfig TestgridConfig `json:"testgrid_config,omitempty"`
 }
 
@@ -60,14 +127,49 @@ type JobsConfig struct {
 
 	SupportReleaseBranching bool `json:"support_release_branching,omitempty"`
 
-	Repo     string   `json:"repo,omitempty"`
-	Org      string   `json:"org,omitempty"`
+	Repo string `json:"repo,omitempty"`
+	Org  string `json:"org,omitempty"`
+	// CloneURI is the URI the repo is cloned from, e.g. over SSH or from a
+	// mirror. The repo is cloned from GitHub when it is not set.
 	CloneURI string   `json:"clone_uri,omitempty"`
 	Branches []string `json:"branches,omitempty"`
 
+	// Team is the team owning the jobs of the file, recorded in the annotation
+	// of the base config team_annotation.
+	Team string `json:"team,omitempty"`
+
+	// EnvFile is the path of a file with KEY=VALUE lines, relative to the meta
+	// config file. The variables are added to the env of all the jobs, with a
+	// lower precedence than the env configured in the meta config file.
+	EnvFile string `json:"env_file,omitempty"`
+
+	// ExcludedBaseRequirements are the requirements of the base config that
+	// are not applied to the jobs in the file. Unlike excluded_requirements,
+	// the jobs can still list them in their own requirements.
+	ExcludedBaseRequirements []string `json:"excluded_base_requirements,omitempty"`
+
+	// Overlays are named patches of the environment specific fields, e.g. for
+	// running the same jobs on two Prow instances. The overlay to generate the
+	// jobs with is selected at generation time.
+	Overlays map[string]Overlay `json:"overlays,omitempty"`
+
+	// FileResourcePresets are the names of the resources presets defined in the
+	// file itself, before the presets of the base config are merged in. It is
+	// set when the file is read.
+	FileResourcePresets []string `json:"-"`
+
 	Jobs []Job `json:"jobs,omitempty"`
 }
 
+// Overlay overrides the cluster, GCS and resources of all the jobs in a file.
+// Each resources preset replaces the preset of the same name.
+type Overlay struct {
+	Cluster          string                             `json:"cluster,omitempty"`
+	GCSLogBucket     string                             `json:"gcs_log_bucket,omitempty"`
+	GCSConfiguration *prowjob.GCSConfiguration          `json:"gcs_configuration,omitempty"`
+	ResourcePresets  map[string]v1.ResourceRequirements `json:"resources_presets,omitempty"`
+}
+
 // Job is the last layer for defining the actual Prow jobs.
 type Job struct {
 	CommonConfig
@@ -80,13 +182,97 @@ type Job struct {
 	Tags    []string `json:"tags,omitempty"`
 	Types   []string `json:"types,omitempty"`
 	Repos   []string `json:"repos,omitempty"`
+
+	Ports []v1.ContainerPort `json:"ports,omitempty"`
+
+	// Volumes and VolumeMounts are added to the pod and the container of the
+	// job, in addition to the ones from the requirements.
+	Volumes      []v1.Volume      `json:"volumes,omitempty"`
+	VolumeMounts []v1.VolumeMount `json:"volumeMounts,omitempty"`
+
 	// Architectures defines architectures to build as. Defaults to amd64.
 	Architectures []string `json:"architectures,omitempty"`
 
-	GerritPresubmitLabel  string `json:"gerrit_presubmit_label,omitempty"`
-	GerritPostsubmitLabel string `json:"gerrit_postsubmit_label,omitempty"`
-
-	ReporterConfig *prowjob.ReporterConfig `json:"reporter_config,omitempty"`
+	// ContextGroup prefixes the GitHub status context of the presubmit as
+	// group/name, so related checks are listed together. It can reference the
+	// matrix, e.g. e2e-$(matrix.version).
+	ContextGroup string `json:"context_group,omitempty"`
+
+	// TriggerLabel is the PR label the presubmit is meant to run for. Prow
+	// cannot gate presubmits on labels, so the presubmit is only run on
+	// demand, and the label is recorded in the TriggerLabelAnnotation for
+	// external automation to trigger it.
+	TriggerLabel string `json:"trigger_label,omitempty"`
+
+	// Team overrides the team of the file for the job.
+	Team string `json:"team,omitempty"`
+
+	// CloneURI overrides the clone_uri of the file for the job.
+	CloneURI string `json:"clone_uri,omitempty"`
+
+	// PresubmitImage, PostsubmitImage and PeriodicImage override the image for
+	// the jobs of that type.
+	PresubmitImage  string `json:"presubmit_image,omitempty"`
+	PostsubmitImage string `json:"postsubmit_image,omitempty"`
+	PeriodicImage   string `json:"periodic_image,omitempty"`
+
+	// UseImageEntrypoint acknowledges that the job relies on the entrypoint of
+	// its image, so it is not required to set a command with --check-commands.
+	// The job must set args instead, since Prow requires a command or args.
+	UseImageEntrypoint bool `json:"use_image_entrypoint,omitempty"`
+
+	// AllowVariantDivergence acknowledges that the containers of the presubmit
+	// and postsubmit generated for the job are meant to differ, which is
+	// otherwise warned about. The images overridden per type are not
+	// considered a divergence.
+	AllowVariantDivergence bool `json:"allow_variant_divergence,omitempty"`
+
+	// RunBeforeMerge makes the presubmit only run by Tide right before the PR is
+	// merged, instead of on every push.
+	RunBeforeMerge *bool `json:"run_before_merge,omitempty"`
+
+	// BeforeMerge is run_before_merge with the status context of the presubmit
+	// required, so it is reported as pending on every PR while the job only
+	// runs in the merge pool of Tide.
+	BeforeMerge bool `json:"before_merge,omitempty"`
+
+	// Optional and SkipReport are explicit alternatives to the
+	// presubmit_optional and hidden modifiers. When set, they take precedence
+	// over the modifiers. Optional only applies to presubmits, and SkipReport
+	// to presubmits and postsubmits.
+	Optional   *bool `json:"optional,omitempty"`
+	SkipReport *bool `json:"skip_report,omitempty"`
+
+	// OptionalBranches are the regexes of the branches the presubmit is
+	// optional on, e.g. feature branches. It is required on the other branches
+	// of the file.
+	OptionalBranches []string `json:"optional_branches,omitempty"`
+
+	// ExcludedBranches is the list of branches of the file the job is not
+	// generated for, e.g. the release branches a feature was not backported to.
+	ExcludedBranches []string `json:"excluded_branches,omitempty"`
+
+	// PostsubmitSkipBranches is the list of branches the postsubmit should not
+	// run on.
+	PostsubmitSkipBranches []string `json:"postsubmit_skip_branches,omitempty"`
+
+	// IntervalFallback generates two periodics for the job, suffixed with -cron
+	// and -interval, so it runs on its cron but also at least every interval.
+	// Both cron and interval must be set.
+	IntervalFallback bool `json:"interval_fallback,omitempty"`
+
+	// ActiveDeadlineSeconds is a hard deadline of the pod of the job, enforced
+	// by Kubernetes independently of the timeout of the decoration.
+	ActiveDeadlineSeconds *int64 `json:"active_deadline_seconds,omitempty"`
+
+	// Jitter is the maximum duration a cron periodic is delayed by. Each
+	// periodic is delayed by a fixed number of minutes derived from its name, so
+	// that periodics with the same cron do not all start at the same time. It
+	// must be less than the interval between the runs of the cron.
+	Jitter string `json:"jitter,omitempty"`
+
+	ReporterConfig  *prowjob.ReporterConfig  `json:"reporter_config,omitempty"`
+	RerunAuthConfig *prowjob.RerunAuthConfig `json:"rerun_auth_config,omitempty"`
 }
 
 // CommonConfig contains all the common fields that can be overlayed through
@@ -94,18 +280,51 @@ type Job struct {
 type CommonConfig struct {
 	GCSLogBucket                  string `json:"gcs_log_bucket,omitempty"`
 	TerminationGracePeriodSeconds int64  `json:"termination_grace_period_seconds,omitempty"`
+	// GCSConfiguration overrides the GCS configuration the artifacts are
+	// uploaded with. The cluster default is used when it is not set.
+	GCSConfiguration *prowjob.GCSConfiguration `json:"gcs_configuration,omitempty"`
+
+	// UploadIgnoresInterrupts makes the artifacts upload continue when the job
+	// is interrupted, and GracePeriod is how long the job is given to finish
+	// after it is interrupted. The cluster defaults are used when they are not
+	// set.
+	UploadIgnoresInterrupts *bool             `json:"upload_ignores_interrupts,omitempty"`
+	GracePeriod             *prowjob.Duration `json:"grace_period,omitempty"`
 
 	Interval string `json:"interval,omitempty"`
 	Cron     string `json:"cron,omitempty"`
 
 	Cluster      string            `json:"cluster,omitempty"`
 	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	// TopologySpreadConstraints control how the pods are spread across the
+	// nodes. The constraints of each layer are added to the ones above it.
+	TopologySpreadConstraints []v1.TopologySpreadConstraint `json:"topology_spread_constraints,omitempty"`
+	// Tolerations allow the pods to be scheduled to tainted nodes. The
+	// tolerations of each layer are added to the ones above it, and they can
+	// reference the matrix, e.g. to tolerate the taint of a node pool per
+	// dimension value.
+	Tolerations []v1.Toleration `json:"tolerations,omitempty"`
+
+	// Privileged sets whether the container of the jobs is privileged.
+	// Defaults to true.
+	Privileged *bool `json:"privileged,omitempty"`
+
+	HostNetwork *bool            `json:"host_network,omitempty"`
+	DNSPolicy   string           `json:"dns_policy,omitempty"`
+	DNSConfig   *v1.PodDNSConfig `json:"dns_config,omitempty"`
 
 	Annotations map[string]string `json:"annotations,omitempty"`
 	Labels      map[string]string `json:"labels,omitempty"`
 
+	// DashboardGroup is the testgrid dashboard group of the dashboards of the
+	// postsubmits and periodics, recorded in an annotation.
+	DashboardGroup string `json:"dashboard_group,omitempty"`
+
 	Matrix map[string][]string `json:"matrix,omitempty"`
 	Params map[string]string   `json:"params,omitempty"`
+	// MatrixLabels labels each job expanded from the matrix with the value of
+	// each dimension it references, keyed by the dimension.
+	MatrixLabels bool `json:"matrix_labels,omitempty"`
 
 	ResourcePresets      map[string]v1.ResourceRequirements `json:"resources_presets,omitempty"`
 	RequirementPresets   map[string]RequirementPreset       `json:"requirement_presets,omitempty"`
@@ -117,10 +336,26 @@ type CommonConfig struct {
 	ImagePullPolicy    string      `json:"image_pull_policy,omitempty"`
 	ImagePullSecrets   []string    `json:"image_pull_secrets,omitempty"`
 	ServiceAccountName string      `json:"service_account_name,omitempty"`
+	PriorityClassName  string      `json:"priority_class_name,omitempty"`
+
+	// SSHKeySecrets are the names of the secrets holding the SSH keys used to
+	// clone the repos, which is needed for private repos.
+	SSHKeySecrets []string `json:"ssh_key_secrets,omitempty"`
 
 	Regex   string `json:"regex,omitempty"`
 	Trigger string `json:"trigger,omitempty"`
 
+	// SkipRegex skips the jobs when all the changed files match it, i.e.
+	// skip_if_only_changed. It cannot be used with regex, including a regex
+	// inherited from the file.
+	SkipRegex string `json:"skip_regex,omitempty"`
+
+	// GerritPresubmitLabel and GerritPostsubmitLabel are the Gerrit labels the
+	// results of the jobs are reported to. Jobs are reported to Gerrit instead
+	// of GitHub when they are set.
+	GerritPresubmitLabel  string `json:"gerrit_presubmit_label,omitempty"`
+	GerritPostsubmitLabel string `json:"gerrit_postsubmit_label,omitempty"`
+
 	Timeout        *prowjob.Duration `json:"timeout,omitempty"`
 	MaxConcurrency int               `json:"max_concurrency,omitempty"`
 
@@ -147,7 +382,17 @@ type RequirementPreset struct {
 	Args         []string          `json:"args,omitempty"`
 	Cron         string            `json:"cron,omitempty"`
 	Secrets      []Secret          `json:"secrets,omitempty"`
-	PodSpec      *v1.PodSpec       `json:"podSpec,omitempty"` // Use this field to add extra PodSpec fields except containers and metadata
+	// Containers are the containers the env, args and volume mounts of the
+	// preset apply to: main for the container of the job, all for all the
+	// containers including sidecars and init containers, or container names.
+	// Defaults to main.
+	Containers []string `json:"containers,omitempty"`
+	// ImagePullPolicy is set on the targeted containers that do not set their
+	// own image pull policy.
+	ImagePullPolicy v1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// Use this field to add extra PodSpec fields except metadata. Containers are
+	// added as sidecars of the job.
+	PodSpec *v1.PodSpec `json:"podSpec,omitempty"`
 }
 
 func (r *RequirementPreset) DeepCopy() RequirementPreset {
@@ -0,0 +1,726 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/robfig/cron.v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+
+	"istio.io/test-infra/tools/prowgen/pkg/decorator"
+	"istio.io/test-infra/tools/prowgen/pkg/spec"
+)
+
+// ValidationResult contains the problems found when validating the meta config.
+// Errors always fail the generation, while Warnings only fail it in strict mode.
+type ValidationResult struct {
+	Errors   []error
+	Warnings []error
+}
+
+func (r *ValidationResult) addErrorf(format string, a ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Errorf(format, a...))
+}
+
+func (r *ValidationResult) addWarningf(format string, a ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Errorf(format, a...))
+}
+
+// Err returns the errors, and the warnings if strict is set, as a single error.
+// It returns nil if there is nothing to report.
+func (r ValidationResult) Err(strict bool) error {
+	var err error
+	for _, e := range r.Errors {
+		err = multierror.Append(err, e)
+	}
+	if strict {
+		for _, w := range r.Warnings {
+			err = multierror.Append(err, w)
+		}
+	}
+	return err
+}
+
+// ValidateJobsConfig validates the meta config of the jobs.
+func (cli *Client) ValidateJobsConfig(fileName string, jobsConfig spec.JobsConfig) ValidationResult {
+	res := ValidationResult{}
+	if jobsConfig.Org == "" {
+		res.addErrorf("%s: org must be set", fileName)
+	}
+	if jobsConfig.Repo == "" {
+		res.addErrorf("%s: repo must be set", fileName)
+	}
+
+	if d := cli.BaseConfig.ProwJobDefaults; d != nil && d.TenantID == "" {
+		res.addErrorf("%s: prowjob_defaults must set tenant_id", fileName)
+	}
+
+	for _, req := range jobsConfig.ExcludedBaseRequirements {
+		if e := validate(req, sets.NewString(cli.BaseConfig.Requirements...), "excluded_base_requirements"); e != nil {
+			res.addErrorf("%s: %v", fileName, e)
+		}
+	}
+	if e := validateSSHKeySecrets(jobsConfig.SSHKeySecrets); e != nil {
+		res.addErrorf("%s: %v", fileName, e)
+	}
+	if e := validateCloneURI(jobsConfig.CloneURI); e != nil {
+		res.addErrorf("%s: %v", fileName, e)
+	}
+	if e := validateGCSConfiguration(jobsConfig.GCSConfiguration); e != nil {
+		res.addErrorf("%s: %v", fileName, e)
+	}
+
+	// Setting the default cluster only has an effect if it overrides the
+	// cluster of the base config.
+	if jobsConfig.Cluster == DefaultCluster && resolveCluster(cli.BaseConfig.ClusterAliases, DefaultCluster) == DefaultCluster {
+		if base := resolveCluster(cli.BaseConfig.ClusterAliases, cli.BaseConfig.Cluster); base == "" || base == DefaultCluster {
+			res.addWarningf("%s: cluster %s has no effect, the jobs are scheduled to the default cluster without it", fileName, DefaultCluster)
+		}
+	}
+
+	// The requirements of each layer are appended to the ones above it, so a
+	// requirement listed more often than in the layer above is redundant.
+	baseRequirements := countStrings(cli.BaseConfig.Requirements)
+	fileRequirements := countStrings(jobsConfig.Requirements)
+	for _, req := range sets.StringKeySet(fileRequirements).List() {
+		if baseRequirements[req] > 0 && fileRequirements[req] > baseRequirements[req] {
+			res.addWarningf("%s: requirement %s is already one of the base requirements", fileName, req)
+		}
+	}
+
+	for _, job := range jobsConfig.Jobs {
+		if jobsConfig.Org == "istio" || jobsConfig.Org == "istio-private" {
+			// Some other orgs may have other naming conventions, but for Istio we use the name separator as
+			// divider between job name, repo, and type. So exclude it from the name.
+			if sep := cli.nameSeparator(); strings.Contains(job.Name, sep) {
+				res.addErrorf("%s: job may not contain '%s' %v", fileName, sep, job.Name)
+			}
+		}
+		if job.Image == "" {
+			res.addErrorf("%s: image must be set for job %v", fileName, job.Name)
+		}
+		if job.GracePeriod != nil && job.GracePeriod.Duration <= 0 {
+			res.addErrorf("%s: grace period %v must be positive for job %v", fileName, job.GracePeriod.Duration, job.Name)
+		}
+		if job.Timeout != nil {
+			if job.Timeout.Duration <= 0 {
+				res.addErrorf("%s: timeout %v must be positive for job %v", fileName, job.Timeout.Duration, job.Name)
+			} else if max := cli.maxTimeout(); job.Timeout.Duration > max {
+				res.addErrorf("%s: timeout %v of job %v exceeds the maximum of %v", fileName, job.Timeout.Duration, job.Name, max)
+			}
+		}
+		if job.ActiveDeadlineSeconds != nil {
+			deadline := time.Duration(*job.ActiveDeadlineSeconds) * time.Second
+			if deadline <= 0 {
+				res.addErrorf("%s: active_deadline_seconds must be positive for job %v", fileName, job.Name)
+			} else if job.Timeout != nil && deadline < job.Timeout.Duration {
+				// The pod would be killed before Prow times the job out, so
+				// the logs and artifacts would not be uploaded.
+				res.addWarningf("%s: active deadline %v of job %v is shorter than its timeout %v", fileName, deadline, job.Name, job.Timeout.Duration)
+			}
+		}
+		for _, image := range []string{job.Image, job.PresubmitImage, job.PostsubmitImage, job.PeriodicImage} {
+			if isLatestImage(image) {
+				res.addWarningf("%s: image %s of job %v is not pinned to a tag or digest", fileName, image, job.Name)
+			}
+		}
+		// Prow requires the decorated containers to set a command or args, so
+		// the jobs running the entrypoint of their image need args.
+		if len(job.Command) == 0 && !hasArgs(job, jobsConfig.RequirementPresets) {
+			switch {
+			case job.UseImageEntrypoint:
+				res.addErrorf("%s: use_image_entrypoint requires args for job %v", fileName, job.Name)
+			case !cli.CheckCommands:
+			case sets.NewString(cli.BaseConfig.EntrypointImages...).Has(imageRepository(job.Image)):
+				res.addErrorf("%s: args must be set for job %v, which runs the entrypoint of image %s", fileName, job.Name, job.Image)
+			default:
+				res.addErrorf("%s: command must be set for job %v, image %s has no default entrypoint", fileName, job.Name, job.Image)
+			}
+		}
+		for _, k := range sets.StringKeySet(job.Labels).List() {
+			if cli.isReservedLabel(k) {
+				res.addWarningf("%s: job %v sets label %s, which overrides the generated value", fileName, job.Name, k)
+			}
+		}
+		for _, k := range sets.StringKeySet(job.Annotations).List() {
+			if cli.isReservedAnnotation(k) {
+				res.addWarningf("%s: job %v sets annotation %s, which overrides the generated value", fileName, job.Name, k)
+			}
+		}
+		if job.MatrixLabels {
+			for _, dim := range sets.StringKeySet(job.Matrix).List() {
+				if errs := validation.IsQualifiedName(dim); len(errs) != 0 {
+					res.addErrorf("%s: matrix dimension %s of job %v is not a valid label key: %s", fileName, dim, job.Name, strings.Join(errs, ", "))
+				}
+			}
+		}
+		if err := decorator.CheckMatrixExpansion(job, jobsConfig.Matrix); err != nil {
+			res.addErrorf("%s: matrix of job %v: %v", fileName, job.Name, err)
+		}
+		for _, key := range decorator.UnknownJobMetadata(job.Labels, job.Annotations, job.Env) {
+			res.addErrorf("%s: job %v references unknown job metadata $(job.%s), must be one of %s", fileName, job.Name,
+				key, strings.Join(decorator.JobMetadataKeys.List(), ", "))
+		}
+		jobRequirements := countStrings(job.Requirements)
+		for _, req := range sets.StringKeySet(jobRequirements).List() {
+			if fileRequirements[req] > 0 && jobRequirements[req] > fileRequirements[req] {
+				res.addWarningf("%s: requirement %s of job %v is already required by the base or file requirements", fileName, req, job.Name)
+			}
+		}
+		// Excluding a requirement the job does not have is a no-op, which is
+		// likely a typo or a requirement that was meant for another job.
+		for _, req := range job.ExcludedRequirements {
+			if !sets.NewString(job.Requirements...).Has(req) {
+				res.addWarningf("%s: excluded requirement %s of job %v is not one of its requirements", fileName, req, job.Name)
+			}
+		}
+		for _, b := range job.ExcludedBranches {
+			if !sets.NewString(jobsConfig.Branches...).Has(b) {
+				res.addWarningf("%s: excluded branch %s of job %v is not one of the branches of the file", fileName, b, job.Name)
+			}
+		}
+		if e := validateSSHKeySecrets(job.SSHKeySecrets); e != nil {
+			res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+		}
+		if e := validateCloneURI(job.CloneURI); e != nil {
+			res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+		}
+		if job.DashboardGroup != "" {
+			if !dashboardGroupRegex.MatchString(job.DashboardGroup) {
+				res.addErrorf("%s: dashboard_group %q of job %v must only contain letters, digits, '.', '_' and '-'",
+					fileName, job.DashboardGroup, job.Name)
+			}
+			if len(job.Types) != 0 && !sets.NewString(job.Types...).HasAny(TypePostsubmit, TypePeriodic) {
+				res.addWarningf("%s: dashboard_group of job %v has no effect, it only applies to postsubmits and periodics", fileName, job.Name)
+			}
+		}
+		if e := validateGCSConfiguration(job.GCSConfiguration); e != nil {
+			res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+		}
+		if job.ImagePullPolicy != "" {
+			if e := validate(job.ImagePullPolicy, sets.NewString(string(v1.PullAlways), string(v1.PullIfNotPresent),
+				string(v1.PullNever)), "image_pull_policy"); e != nil {
+				res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+			}
+		}
+		for _, k := range cli.BaseConfig.ProtectedLabels {
+			if v, ok := cli.BaseConfig.Labels[k]; ok && job.Labels[k] != v {
+				res.addWarningf("%s: job %v cannot override the protected label %s, %q is used", fileName, job.Name, k, v)
+			}
+		}
+		for _, k := range cli.BaseConfig.ProtectedAnnotations {
+			if v, ok := cli.BaseConfig.Annotations[k]; ok && job.Annotations[k] != v {
+				res.addWarningf("%s: job %v cannot override the protected annotation %s, %q is used", fileName, job.Name, k, v)
+			}
+		}
+		if job.TerminationGracePeriodSeconds < 0 {
+			res.addErrorf("%s: termination_grace_period_seconds cannot be negative for job %v", fileName, job.Name)
+		}
+		if job.DNSPolicy != "" {
+			if e := validate(job.DNSPolicy, sets.NewString(string(v1.DNSClusterFirst), string(v1.DNSClusterFirstWithHostNet),
+				string(v1.DNSDefault), string(v1.DNSNone)), "dns_policy"); e != nil {
+				res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+			}
+			if job.DNSPolicy == string(v1.DNSNone) && (job.DNSConfig == nil || len(job.DNSConfig.Nameservers) == 0) {
+				res.addErrorf("%s: dns_config must set nameservers when dns_policy is %s for job %v", fileName, v1.DNSNone, job.Name)
+			}
+		}
+		for _, c := range job.TopologySpreadConstraints {
+			if c.MaxSkew < 1 {
+				res.addErrorf("%s: topology spread constraint maxSkew must be at least 1 for job %v", fileName, job.Name)
+			}
+			if c.TopologyKey == "" {
+				res.addErrorf("%s: topology spread constraint topologyKey must be set for job %v", fileName, job.Name)
+			}
+			if e := validate(string(c.WhenUnsatisfiable), sets.NewString(string(v1.DoNotSchedule), string(v1.ScheduleAnyway)),
+				"whenUnsatisfiable"); e != nil {
+				res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+			}
+		}
+		for _, t := range job.Tolerations {
+			if e := validate(string(t.Operator), sets.NewString("", string(v1.TolerationOpEqual), string(v1.TolerationOpExists)),
+				"toleration operator"); e != nil {
+				res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+			}
+			if t.Operator == v1.TolerationOpExists && t.Value != "" {
+				res.addErrorf("%s: toleration %s must not set a value with operator %s for job %v", fileName, t.Key, v1.TolerationOpExists, job.Name)
+			}
+			if t.Key == "" && t.Operator != v1.TolerationOpExists {
+				res.addErrorf("%s: toleration without a key must use operator %s for job %v", fileName, v1.TolerationOpExists, job.Name)
+			}
+			if e := validate(string(t.Effect), sets.NewString("", string(v1.TaintEffectNoSchedule), string(v1.TaintEffectPreferNoSchedule),
+				string(v1.TaintEffectNoExecute)), "toleration effect"); e != nil {
+				res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+			}
+		}
+		portNames := sets.NewString()
+		for _, port := range job.Ports {
+			if port.ContainerPort < 1 || port.ContainerPort > 65535 {
+				res.addErrorf("%s: port %d must be between 1 and 65535 for job %v", fileName, port.ContainerPort, job.Name)
+			}
+			if port.Name != "" {
+				if portNames.Has(port.Name) {
+					res.addErrorf("%s: duplicate port name %q for job %v", fileName, port.Name, job.Name)
+				}
+				portNames.Insert(port.Name)
+			}
+		}
+		if c, f := cli.BaseConfig.ClusterAliases[job.Cluster]; f && c == "" {
+			res.addErrorf("%s: cluster alias %s of job %v does not map to a cluster", fileName, job.Cluster, job.Name)
+		}
+		if known := cli.BaseConfig.KnownClusters; len(known) != 0 && job.Cluster != "" {
+			if c := resolveCluster(cli.BaseConfig.ClusterAliases, job.Cluster); c != DefaultCluster && !sets.NewString(known...).Has(c) {
+				res.addErrorf("%s: unknown cluster %s for job %v, must be one of %v", fileName, c, job.Name, strings.Join(known, ", "))
+			}
+		}
+		// Requirement volumes are deduplicated by name, so a volume that is
+		// defined differently would be silently dropped.
+		volumes := map[string]v1.Volume{}
+		for _, vl := range job.Volumes {
+			if _, ok := volumes[vl.Name]; ok {
+				res.addErrorf("%s: duplicate volume %s for job %v", fileName, vl.Name, job.Name)
+			}
+			volumes[vl.Name] = vl
+		}
+		excluded := sets.NewString(job.ExcludedRequirements...)
+		for _, req := range job.Requirements {
+			if excluded.Has(req) {
+				continue
+			}
+			for _, vl := range jobsConfig.RequirementPresets[req].Volumes {
+				if existing, ok := volumes[vl.Name]; ok && !equality.Semantic.DeepEqual(existing, vl) {
+					res.addErrorf("%s: volume %s of requirement %s conflicts with a different volume of the same name for job %v",
+						fileName, vl.Name, req, job.Name)
+				}
+				volumes[vl.Name] = vl
+			}
+		}
+		// Presets can only target the containers the requirements of the job add.
+		containers := sets.NewString(decorator.ContainersMain, decorator.ContainersAll)
+		for _, req := range job.Requirements {
+			if podSpec := jobsConfig.RequirementPresets[req].PodSpec; podSpec != nil && !excluded.Has(req) {
+				for _, c := range append(podSpec.Containers, podSpec.InitContainers...) {
+					containers.Insert(c.Name)
+				}
+			}
+		}
+		for _, req := range job.Requirements {
+			if excluded.Has(req) {
+				continue
+			}
+			for _, c := range jobsConfig.RequirementPresets[req].Containers {
+				if !containers.Has(c) {
+					res.addErrorf("%s: unknown container %s targeted by requirement %s for job %v", fileName, c, req, job.Name)
+				}
+			}
+			if policy := jobsConfig.RequirementPresets[req].ImagePullPolicy; policy != "" {
+				if e := validate(string(policy), sets.NewString(string(v1.PullAlways), string(v1.PullIfNotPresent),
+					string(v1.PullNever)), "imagePullPolicy of requirement "+req); e != nil {
+					res.addErrorf("%s: job %v: %v", fileName, job.Name, e)
+				}
+			}
+		}
+		for _, name := range sets.StringKeySet(volumes).List() {
+			vl := volumes[name]
+			if vl.HostPath != nil && !isAllowedHostPath(vl.HostPath.Path, cli.BaseConfig.AllowedHostPaths) {
+				res.addErrorf("%s: host path %s of volume %s is not allowed for job %v", fileName, vl.HostPath.Path, name, job.Name)
+			}
+			if vl.EmptyDir != nil && vl.EmptyDir.SizeLimit != nil && vl.EmptyDir.SizeLimit.Sign() <= 0 {
+				res.addErrorf("%s: size limit %s of volume %s must be positive for job %v", fileName, vl.EmptyDir.SizeLimit, name, job.Name)
+			}
+		}
+		for _, vm := range job.VolumeMounts {
+			if _, ok := volumes[vm.Name]; !ok {
+				res.addErrorf("%s: volume mount %s of job %v does not reference a declared volume", fileName, vm.Name, job.Name)
+			}
+		}
+		if job.Resources != "" {
+			if _, f := jobsConfig.ResourcePresets[job.Resources]; !f {
+				res.addErrorf("%s: job '%v' has nonexistant resource '%v'", fileName, job.Name, job.Resources)
+			} else if cli.LocalResources && !sets.NewString(jobsConfig.FileResourcePresets...).Has(job.Resources) {
+				res.addErrorf("%s: job %v references resources %s, which is only defined in the base config", fileName, job.Name, job.Resources)
+			}
+		}
+
+		if sets.NewString(job.Types...).Has(TypePeriodic) {
+			if job.IntervalFallback && (job.Cron == "" || job.Interval == "") {
+				res.addErrorf("%s: cron and interval must be both set in periodic %s with interval_fallback", fileName, job.Name)
+			} else if !job.IntervalFallback && job.Cron != "" && job.Interval != "" {
+				res.addErrorf("%s: cron and interval cannot be both set in periodic %s", fileName, job.Name)
+			} else if job.Cron == "" && job.Interval == "" {
+				res.addErrorf("%s: cron and interval cannot be both empty in periodic %s", fileName, job.Name)
+			}
+			if job.Cron != "" {
+				if _, e := cron.Parse(job.Cron); e != nil {
+					res.addErrorf("%s: invalid cron string %s in periodic %s: %v", fileName, job.Cron, job.Name, e)
+				}
+			}
+			if job.Interval != "" {
+				if _, e := time.ParseDuration(job.Interval); e != nil {
+					res.addErrorf("%s: cannot parse duration %s in periodic %s: %v", fileName, job.Interval, job.Name, e)
+				}
+			}
+		} else if job.IntervalFallback {
+			res.addErrorf("%s: interval_fallback can only be set for periodic %s", fileName, job.Name)
+		} else if (job.Interval != "" || job.Cron != "") && (job.Interval != jobsConfig.Interval || job.Cron != jobsConfig.Cron) {
+			// The schedule is ignored without the periodic type, which is a common
+			// copy-paste mistake. A schedule inherited from the file is meant for
+			// the periodics of the file.
+			res.addWarningf("%s: the schedule of job %s is ignored, since it is not of type %s", fileName, job.Name, TypePeriodic)
+		}
+		if job.Regex != "" && job.SkipRegex != "" {
+			res.addErrorf("%s: regex and skip_regex cannot be used together in job %s, either may be inherited from the file", fileName, job.Name)
+		}
+		for _, re := range []string{job.Regex, job.SkipRegex} {
+			if _, e := regexp.Compile(re); e != nil {
+				res.addErrorf("%s: invalid regex %q in job %s: %v", fileName, re, job.Name, e)
+			}
+		}
+		if job.TriggerLabel != "" && (job.Regex != "" || (job.RunBeforeMerge != nil && *job.RunBeforeMerge)) {
+			res.addErrorf("%s: trigger_label cannot be used with regex or run_before_merge in job %s", fileName, job.Name)
+		}
+		modifiers := sets.NewString(job.Modifiers...)
+		if job.Optional != nil && !*job.Optional {
+			if modifiers.Has(decorator.ModifierPresubmitOptional) {
+				res.addErrorf("%s: optional is false but the %s modifier is set for job %s", fileName, decorator.ModifierPresubmitOptional, job.Name)
+			}
+			if job.TriggerLabel != "" {
+				res.addErrorf("%s: optional cannot be false with trigger_label in job %s, the presubmit may never run", fileName, job.Name)
+			}
+		}
+		if job.SkipReport != nil && !*job.SkipReport && modifiers.Has(decorator.ModifierHidden) {
+			res.addErrorf("%s: skip_report is false but the %s modifier is set for job %s", fileName, decorator.ModifierHidden, job.Name)
+		}
+		optional := modifiers.Has(decorator.ModifierPresubmitOptional) || (job.Optional != nil && *job.Optional)
+		if modifiers.Has(decorator.ModifierSerial) && job.MaxConcurrency > 1 {
+			res.addErrorf("%s: the %s modifier conflicts with max_concurrency %d for job %s", fileName, decorator.ModifierSerial,
+				job.MaxConcurrency, job.Name)
+		}
+		if job.Regex != "" && optional &&
+			(len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePresubmit)) {
+			res.addWarningf("%s: presubmit %s is optional and only runs on changes matching regex, so it never blocks merging", fileName, job.Name)
+		}
+		if job.BeforeMerge {
+			// The status context is only reported as pending if it is required.
+			switch {
+			case len(job.Types) != 0 && !sets.NewString(job.Types...).Has(TypePresubmit):
+				res.addErrorf("%s: before_merge can only be set for presubmit %s", fileName, job.Name)
+			case job.Regex != "" || job.TriggerLabel != "":
+				res.addErrorf("%s: before_merge cannot be used with regex or trigger_label in job %s", fileName, job.Name)
+			case job.RunBeforeMerge != nil && !*job.RunBeforeMerge:
+				res.addErrorf("%s: before_merge cannot be used with run_before_merge false in job %s", fileName, job.Name)
+			case optional:
+				res.addErrorf("%s: before_merge cannot be used with an optional presubmit %s, its status would not be required", fileName, job.Name)
+			case modifiers.Has(decorator.ModifierHidden) || (job.SkipReport != nil && *job.SkipReport):
+				res.addErrorf("%s: before_merge cannot be used with a presubmit %s that is not reported", fileName, job.Name)
+			}
+		}
+		if len(job.OptionalBranches) != 0 {
+			switch {
+			case len(job.Types) != 0 && !sets.NewString(job.Types...).Has(TypePresubmit):
+				res.addErrorf("%s: optional_branches can only be set for presubmit %s", fileName, job.Name)
+			case optional:
+				res.addErrorf("%s: optional_branches cannot be used with presubmit %s that is optional on all the branches", fileName, job.Name)
+			case job.BeforeMerge || job.TriggerLabel != "":
+				res.addErrorf("%s: optional_branches cannot be used with before_merge or trigger_label in job %s", fileName, job.Name)
+			}
+			for _, b := range job.OptionalBranches {
+				if _, e := regexp.Compile(fmt.Sprintf("^%s$", b)); e != nil {
+					res.addErrorf("%s: invalid optional branch %s in job %s: %v", fileName, b, job.Name, e)
+				}
+			}
+		}
+		if job.RunBeforeMerge != nil && *job.RunBeforeMerge && job.Regex != "" {
+			res.addErrorf("%s: run_before_merge cannot be used with regex in job %s, Tide would run it regardless of the changed files", fileName, job.Name)
+		}
+		if job.Jitter != "" {
+			d, e := time.ParseDuration(job.Jitter)
+			if e != nil {
+				res.addErrorf("%s: cannot parse jitter %s in job %s: %v", fileName, job.Jitter, job.Name, e)
+			} else if d < time.Minute {
+				res.addErrorf("%s: jitter %s in job %s must be at least 1m", fileName, job.Jitter, job.Name)
+			}
+			if job.Interval != "" && !job.IntervalFallback {
+				res.addErrorf("%s: jitter cannot be used with interval in job %s, Prow always starts interval periodics immediately", fileName, job.Name)
+			} else if job.Cron != "" && e == nil && d >= time.Minute {
+				if e := validateCronJitter(job.Cron, d); e != nil {
+					res.addErrorf("%s: jitter %s in job %s: %v", fileName, job.Jitter, job.Name, e)
+				}
+			}
+		}
+		types := sets.NewString()
+		for _, t := range job.Types {
+			if e := validate(t, sets.NewString(TypePostsubmit, TypePresubmit, TypePeriodic), "type"); e != nil {
+				res.Errors = append(res.Errors, e)
+			}
+			if types.Has(t) {
+				res.addErrorf("%s: duplicate type %s for job %v", fileName, t, job.Name)
+			}
+			types.Insert(t)
+		}
+		for _, t := range job.Architectures {
+			if e := validate(t, sets.NewString(ArchAMD64, ArchARM64, TypePeriodic), "architectures"); e != nil {
+				res.Errors = append(res.Errors, e)
+			}
+		}
+		for _, b := range job.PostsubmitSkipBranches {
+			if _, e := regexp.Compile(fmt.Sprintf("^%s$", b)); e != nil || strings.TrimSpace(b) != b || b == "" {
+				res.addErrorf("%s: invalid postsubmit skip branch %q for job %v", fileName, b, job.Name)
+			}
+		}
+		if rac := job.RerunAuthConfig; rac != nil && !rac.AllowAnyone && len(rac.GitHubUsers) == 0 &&
+			len(rac.GitHubOrgs) == 0 && len(rac.GitHubTeamIDs) == 0 && len(rac.GitHubTeamSlugs) == 0 {
+			res.addErrorf("%s: rerun_auth_config must allow at least one user, org or team for job %v", fileName, job.Name)
+		}
+		for _, repo := range job.Repos {
+			if len(strings.Split(repo, "/")) != 2 {
+				res.addErrorf("%s: repo %v not valid, should take form org/repo", fileName, repo)
+			}
+		}
+	}
+
+	return res
+}
+
+// isAllowedHostPath returns true if the path is one of the allowed paths or
+// under one of them, or if there are no allowed paths configured.
+func isAllowedHostPath(path string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	path = filepath.Clean(path)
+	for _, a := range allowed {
+		a = filepath.Clean(a)
+		if path == a || strings.HasPrefix(path, strings.TrimSuffix(a, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// imageRepository returns the image without its tag or digest.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i != -1 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// isLatestImage returns true if the image is not pinned to a tag or digest, or
+// uses the latest tag.
+func isLatestImage(image string) bool {
+	if image == "" || strings.Contains(image, "@") {
+		return false
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	return i == -1 || name[i+1:] == "latest"
+}
+
+func validate(input string, options sets.String, description string) error {
+	if !options.Has(input) {
+		return fmt.Errorf("'%v' is not a valid %v. Must be one of %v", input, description, strings.Join(options.List(), ", "))
+	}
+	return nil
+}
+
+// validateSSHKeySecrets checks that the ssh_key_secrets, when set, name at
+// least one secret and do not contain empty names.
+func validateSSHKeySecrets(secrets []string) error {
+	if secrets == nil {
+		return nil
+	}
+	if len(secrets) == 0 {
+		return fmt.Errorf("ssh_key_secrets must not be empty when set")
+	}
+	for _, s := range secrets {
+		if s == "" {
+			return fmt.Errorf("ssh_key_secrets must not contain empty secret names")
+		}
+	}
+	return nil
+}
+
+// cloneURIRegex matches the URLs git can clone from, either with a scheme or in
+// the scp-like syntax, e.g. git@github.com:istio/istio.git.
+var cloneURIRegex = regexp.MustCompile(`^((https?|ssh|git|file)://[^\s]+|[\w.-]+@[\w.-]+:[^\s]+)$`)
+
+// dashboardGroupRegex matches the valid names of the testgrid dashboard groups.
+var dashboardGroupRegex = regexp.MustCompile(`^[\w.-]+$`)
+
+// validateCronJitter checks that the jitter is less than the interval between
+// the runs of the cron, and that the cron can be delayed by up to the jitter.
+func validateCronJitter(cronstr string, jitter time.Duration) error {
+	sched, err := cron.Parse(cronstr)
+	if err != nil {
+		// The invalid cron is reported by the validation of the periodics.
+		return nil
+	}
+	// The shortest interval between the next runs, starting from a fixed time
+	// so that the validation is stable.
+	t := sched.Next(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC))
+	for i := 0; i < 100 && !t.IsZero(); i++ {
+		next := sched.Next(t)
+		if !next.IsZero() && next.Sub(t) <= jitter {
+			return fmt.Errorf("must be less than the interval %v between the runs of cron %q", next.Sub(t), cronstr)
+		}
+		t = next
+	}
+	_, err = delayCron(cronstr, int(jitter/time.Minute)-1)
+	return err
+}
+
+// hasArgs returns whether the main container of the job has args, either its
+// own or from its requirements.
+func hasArgs(job spec.Job, presets map[string]spec.RequirementPreset) bool {
+	if len(job.Args) != 0 {
+		return true
+	}
+	for _, req := range decorator.EffectiveRequirements(job.Requirements, job.ExcludedRequirements) {
+		preset := presets[req]
+		targets := sets.NewString(preset.Containers...)
+		if len(preset.Args) != 0 && (targets.Len() == 0 || targets.HasAny(decorator.ContainersMain, decorator.ContainersAll)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCloneURI checks that the clone_uri, when set, is a git URL.
+func validateCloneURI(uri string) error {
+	if uri != "" && !cloneURIRegex.MatchString(uri) {
+		return fmt.Errorf("clone_uri %q is not a git URL", uri)
+	}
+	return nil
+}
+
+// validateGCSConfiguration checks the path strategy of the gcs_configuration,
+// and that the default org and repo are set for the strategies that need them.
+func validateGCSConfiguration(gcs *prowjob.GCSConfiguration) error {
+	if gcs == nil || gcs.PathStrategy == "" {
+		return nil
+	}
+	if e := validate(gcs.PathStrategy, sets.NewString(prowjob.PathStrategyLegacy, prowjob.PathStrategySingle,
+		prowjob.PathStrategyExplicit), "gcs_configuration.path_strategy"); e != nil {
+		return e
+	}
+	if gcs.PathStrategy != prowjob.PathStrategyExplicit && (gcs.DefaultOrg == "" || gcs.DefaultRepo == "") {
+		return fmt.Errorf("gcs_configuration must set default_org and default_repo for path strategy %q", gcs.PathStrategy)
+	}
+	return nil
+}
+
+// checkVariantDivergence compares the containers of the presubmit and
+// postsubmit generated for the same job, and returns an error listing the
+// fields that differ. The image of the main container is not compared if the
+// job overrides it for either type, and the name of each job, which can be
+// referenced as $(job.name), is not considered a difference.
+func checkVariantDivergence(presubmit, postsubmit config.JobBase, job spec.Job) error {
+	if presubmit.Spec == nil || postsubmit.Spec == nil {
+		return nil
+	}
+	pre := v1.PodSpec{Containers: presubmit.Spec.Containers, InitContainers: presubmit.Spec.InitContainers}
+	post := v1.PodSpec{Containers: postsubmit.Spec.Containers, InitContainers: postsubmit.Spec.InitContainers}
+	if (job.PresubmitImage != "" || job.PostsubmitImage != "") && len(pre.Containers) != 0 && len(post.Containers) != 0 {
+		// The pull policy defaults differently for the latest tag.
+		post.Containers = append([]v1.Container(nil), post.Containers...)
+		post.Containers[0].Image = pre.Containers[0].Image
+		post.Containers[0].ImagePullPolicy = pre.Containers[0].ImagePullPolicy
+	}
+	o, err := toGenericValue(pre)
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	bs = bytes.ReplaceAll(bs, []byte(postsubmit.Name), []byte(presubmit.Name))
+	var n interface{}
+	if err := json.Unmarshal(bs, &n); err != nil {
+		return err
+	}
+	var changes []FieldChange
+	diffValues("spec", o, n, &changes)
+	if len(changes) == 0 {
+		return nil
+	}
+	fields := make([]string, 0, len(changes))
+	for _, c := range changes {
+		fields = append(fields, c.Field)
+	}
+	return fmt.Errorf("the presubmit and postsubmit differ in %s", strings.Join(fields, ", "))
+}
+
+// matchesBranch returns whether the jobs of the brancher can run for the branch,
+// i.e. the branch matches one of its branches, if any, and none of its skip
+// branches. Patterns that cannot be compiled are validated separately.
+func matchesBranch(brancher config.Brancher, branch string) bool {
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if re, err := regexp.Compile(p); err == nil && re.MatchString(branch) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(brancher.SkipBranches) {
+		return false
+	}
+	return len(brancher.Branches) == 0 || matches(brancher.Branches)
+}
+
+// prowLabels are the labels Prow sets on the pods of the jobs.
+var prowLabels = sets.NewString(kube.CreatedByProw, kube.ProwJobTypeLabel, kube.ProwJobIDLabel, kube.ProwBuildIDLabel,
+	kube.ProwJobAnnotation, kube.ContextAnnotation, kube.PlankVersionLabel, kube.OrgLabel, kube.RepoLabel,
+	kube.BaseRefLabel, kube.PullLabel)
+
+// isReservedLabel returns whether the label is set by the generator or Prow.
+func (cli *Client) isReservedLabel(key string) bool {
+	return prowLabels.Has(key) || (cli.BaseConfig.BranchLabel != "" && key == cli.BaseConfig.BranchLabel)
+}
+
+// isReservedAnnotation returns whether the annotation is set by the generator.
+// The testgrid annotations set on a job are kept by the generator, so they are
+// not reserved.
+func (cli *Client) isReservedAnnotation(key string) bool {
+	return key == TriggerLabelAnnotation
+}
+
+// countStrings returns the number of times each string is in the list.
+func countStrings(list []string) map[string]int {
+	counts := map[string]int{}
+	for _, s := range list {
+		counts[s]++
+	}
+	return counts
+}
@@ -0,0 +1,1014 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
+)
+
+func TestValidationWarnings(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:latest
+jobs:
+- name: unit
+  command: [make, test]
+`)
+
+	res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+	if len(res.Errors) != 0 || len(res.Warnings) != 1 {
+		t.Fatalf("expected only one warning, got errors %v and warnings %v", res.Errors, res.Warnings)
+	}
+	if _, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master"); err != nil {
+		t.Fatalf("expected warnings to pass in non-strict mode, but received %v", err)
+	}
+
+	strictCli := &Client{BaseConfig: bc, Strict: true}
+	if _, err := strictCli.ConvertJobConfig("jobs.yaml", jobs, "master"); err == nil {
+		t.Fatal("expected warnings to fail in strict mode, but did not receive an error")
+	}
+}
+
+func TestIsLatestImage(t *testing.T) {
+	tests := map[string]bool{
+		"gcr.io/istio-testing/build-tools":                     true,
+		"gcr.io/istio-testing/build-tools:latest":              true,
+		"localhost:5000/build-tools":                           true,
+		"gcr.io/istio-testing/build-tools:master-2021-08-09":   false,
+		"localhost:5000/build-tools:v1":                        false,
+		"gcr.io/istio-testing/build-tools@sha256:0123456789ab": false,
+	}
+	for image, want := range tests {
+		if got := isLatestImage(image); got != want {
+			t.Errorf("isLatestImage(%q) = %v, want %v", image, got, want)
+		}
+	}
+}
+
+func TestValidateTerminationGracePeriod(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  command: [make, test]
+  termination_grace_period_seconds: -1
+`)
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for a negative termination grace period, but did not receive one")
+	}
+}
+
+func TestValidateDNSPolicy(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"dns_policy: ClusterFirst": false,
+		"dns_policy: Invalid":      true,
+		"dns_policy: None":         true,
+		"dns_policy: None\n  dns_config: {nameservers: [1.1.1.1]}": false,
+	}
+	for dns, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  command: [make, test]
+  `+dns+"\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", dns, expectError, res.Errors)
+		}
+		for _, e := range res.Errors {
+			if !strings.HasPrefix(e.Error(), "jobs.yaml: ") {
+				t.Errorf("%q: expected the error to name the file, got %v", dns, e)
+			}
+		}
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		name        string
+		ports       string
+		expectError bool
+	}{
+		{
+			name:  "valid",
+			ports: "[{name: http, containerPort: 8080}, {name: grpc, containerPort: 9090}]",
+		},
+		{
+			name:        "out of range",
+			ports:       "[{containerPort: 70000}]",
+			expectError: true,
+		},
+		{
+			name:        "duplicate name",
+			ports:       "[{name: http, containerPort: 8080}, {name: http, containerPort: 9090}]",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  command: [make, test]
+  ports: `+tt.ports+"\n")
+			if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != tt.expectError {
+				t.Fatalf("expected error %v, got %v", tt.expectError, res.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateKnownClusters(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.KnownClusters = []string{"istio-build", "prow-trusted"}
+	bc.ClusterAliases = map[string]string{"build-trusted": "prow-trusted"}
+	cli := &Client{BaseConfig: bc}
+	tests := map[string]bool{
+		"istio-build":   false,
+		"build-trusted": false,
+		"default":       false,
+		"istio-biuld":   true,
+	}
+	for cluster, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  command: [make, test]
+  cluster: `+cluster+"\n")
+		if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", cluster, expectError, res.Errors)
+		}
+	}
+}
+
+func TestValidateJitter(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"cron: \"0 4 * * *\"\n  jitter: 30m":   false,
+		"cron: \"0 4 * * *\"\n  jitter: foo":   true,
+		"cron: \"0 4 * * *\"\n  jitter: 30s":   true,
+		"cron: \"0 4 * * *\"\n  jitter: 2h":    false,
+		"cron: \"0 4 * * *\"\n  jitter: 24h":   true,
+		"cron: \"50 4 * * *\"\n  jitter: 30m":  false,
+		"cron: \"50 23 * * 1\"\n  jitter: 30m": true,
+		"cron: \"0 * * * *\"\n  jitter: 30m":   false,
+		"cron: \"0 * * * *\"\n  jitter: 1h":    true,
+		"cron: \"*/5 * * * *\"\n  jitter: 30m": true,
+		"interval: 2h\n  jitter: 30m":          true,
+	}
+	for schedule, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage
+jobs:
+- name: unit
+  types: [periodic]
+  command: [make, test]
+  `+schedule+"\n")
+		if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", schedule, expectError, res.Errors)
+		}
+	}
+}
+
+func TestValidateImagePullPolicy(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"Always":       false,
+		"IfNotPresent": false,
+		"Never":        false,
+		"Sometimes":    true,
+	}
+	for policy, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  image_pull_policy: `+policy+"\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", policy, expectError, res.Errors)
+		}
+		for _, e := range res.Errors {
+			if !strings.HasPrefix(e.Error(), "jobs.yaml: ") {
+				t.Errorf("%q: expected the error to name the file, got %v", policy, e)
+			}
+		}
+	}
+}
+
+func TestValidateRunBeforeMerge(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  run_before_merge: true
+  regex: '\.go$'
+`)
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for run_before_merge with regex, but did not receive one")
+	}
+}
+
+func TestValidateTypes(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"[presubmit, postsubmit]": false,
+		"[presubmit, presubmit]":  true,
+		"[presubmit, unknown]":    true,
+	}
+	for types, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  types: `+types+"\n")
+		if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", types, expectError, res.Errors)
+		}
+	}
+}
+
+func TestValidateRequirementVolumes(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		name        string
+		volume      string
+		expectError bool
+	}{
+		{
+			name:   "shared",
+			volume: "{name: cache, emptyDir: {}}",
+		},
+		{
+			name:        "collision",
+			volume:      "{name: cache, hostPath: {path: /var/tmp/cache}}",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+requirement_presets:
+  first:
+    volumes: [{name: cache, emptyDir: {}}]
+  second:
+    volumes: [`+tt.volume+`]
+jobs:
+- name: unit
+  command: [make, test]
+  requirements: [first, second]
+`)
+			if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != tt.expectError {
+				t.Errorf("expected error %v, got %v", tt.expectError, res.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeMounts(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  volumes:
+  - name: scratch
+    emptyDir: {}
+  volumeMounts:
+  - name: scrach
+    mountPath: /scratch
+`)
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Fatal("expected an error for a mount of an undeclared volume, but did not receive one")
+	}
+}
+
+func TestValidateVolumes(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.AllowedHostPaths = []string{"/var/tmp/prow", "/lib/modules"}
+	cli := &Client{BaseConfig: bc}
+	tests := []struct {
+		name        string
+		volume      string
+		expectError bool
+	}{
+		{
+			name:   "allowed host path",
+			volume: "{name: scratch, hostPath: {path: /var/tmp/prow/scratch}}",
+		},
+		{
+			name:        "disallowed host path",
+			volume:      "{name: scratch, hostPath: {path: /var/run/docker.sock}}",
+			expectError: true,
+		},
+		{
+			name:        "host path with an allowed prefix",
+			volume:      "{name: scratch, hostPath: {path: /var/tmp/prowler}}",
+			expectError: true,
+		},
+		{
+			name:   "size limit",
+			volume: "{name: scratch, emptyDir: {sizeLimit: 1Gi}}",
+		},
+		{
+			name:        "negative size limit",
+			volume:      "{name: scratch, emptyDir: {sizeLimit: -1Gi}}",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  volumes: [`+tt.volume+`]
+`)
+			if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != tt.expectError {
+				t.Errorf("expected error %v, got %v", tt.expectError, res.Errors)
+			}
+		})
+	}
+}
+
+func TestIsAllowedHostPath(t *testing.T) {
+	if !isAllowedHostPath("/anything", nil) {
+		t.Error("expected any host path to be allowed without an allowlist")
+	}
+	if !isAllowedHostPath("/var/tmp/prow/../prow/cache", []string{"/var/tmp/prow/"}) {
+		t.Error("expected the cleaned path to be allowed")
+	}
+	if isAllowedHostPath("/var/tmp/prow/../../etc", []string{"/var/tmp/prow"}) {
+		t.Error("expected a path escaping the allowed path to not be allowed")
+	}
+}
+
+func TestValidateTopologySpreadConstraints(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"{maxSkew: 1, topologyKey: kubernetes.io/hostname, whenUnsatisfiable: ScheduleAnyway}": false,
+		"{maxSkew: 0, topologyKey: kubernetes.io/hostname, whenUnsatisfiable: ScheduleAnyway}": true,
+		"{maxSkew: 1, whenUnsatisfiable: ScheduleAnyway}":                                      true,
+		"{maxSkew: 1, topologyKey: kubernetes.io/hostname}":                                    true,
+	}
+	for constraint, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  topology_spread_constraints: [`+constraint+"]\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", constraint, expectError, res.Errors)
+		}
+		for _, e := range res.Errors {
+			if !strings.HasPrefix(e.Error(), "jobs.yaml: ") {
+				t.Errorf("%q: expected the error to name the file, got %v", constraint, e)
+			}
+		}
+	}
+}
+
+func TestValidateTolerations(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"{key: dedicated, value: build, effect: NoSchedule}":    false,
+		"{key: dedicated, operator: Exists}":                    false,
+		"{operator: Exists}":                                    false,
+		"{key: dedicated, operator: Exists, value: build}":      true,
+		"{key: dedicated, operator: Matches, value: build}":     true,
+		"{value: build}":                                        true,
+		"{key: dedicated, value: build, effect: NeverSchedule}": true,
+	}
+	for toleration, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  tolerations: [`+toleration+"]\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", toleration, expectError, res.Errors)
+		}
+		for _, e := range res.Errors {
+			if !strings.HasPrefix(e.Error(), "jobs.yaml: ") {
+				t.Errorf("%q: expected the error to name the file, got %v", toleration, e)
+			}
+		}
+	}
+}
+
+func TestValidateCommands(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.EntrypointImages = []string{"gcr.io/istio-testing/prowgen"}
+	cli := &Client{BaseConfig: bc, CheckCommands: true}
+	tests := []struct {
+		name        string
+		job         string
+		expectError bool
+	}{
+		{
+			name: "command",
+			job:  "image: fooimage:1.0\n  command: [make, test]",
+		},
+		{
+			name:        "no command",
+			job:         "image: fooimage:1.0",
+			expectError: true,
+		},
+		{
+			name: "args",
+			job:  "image: fooimage:1.0\n  args: [--verbose]",
+		},
+		{
+			name: "entrypoint image",
+			job:  "image: gcr.io/istio-testing/prowgen:1.0\n  args: [--verbose]",
+		},
+		{
+			name:        "entrypoint image without args",
+			job:         "image: gcr.io/istio-testing/prowgen:1.0",
+			expectError: true,
+		},
+		{
+			name: "entrypoint image with args from requirements",
+			job:  "image: gcr.io/istio-testing/prowgen:1.0\n  requirements: [verbose]",
+		},
+		{
+			name: "use image entrypoint",
+			job:  "image: fooimage:1.0\n  use_image_entrypoint: true\n  args: [--verbose]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+requirement_presets:
+  verbose:
+    args: [--verbose]
+jobs:
+- name: unit
+  `+tt.job+"\n")
+			if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != tt.expectError {
+				t.Errorf("expected error %v, got %v", tt.expectError, res.Errors)
+			}
+			cli := &Client{BaseConfig: bc}
+			if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) != 0 {
+				t.Errorf("expected no errors without checking the commands, got %v", res.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateReservedKeys(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	bc.BranchLabel = "branch"
+	bc.TestgridConfig.Enabled = true
+	cli := &Client{BaseConfig: bc}
+	tests := []struct {
+		name          string
+		job           string
+		expectWarning bool
+	}{
+		{
+			name: "custom label",
+			job:  "labels:\n    team: infra",
+		},
+		{
+			name:          "branch label",
+			job:           "labels:\n    branch: master",
+			expectWarning: true,
+		},
+		{
+			name:          "prow label",
+			job:           "labels:\n    prow.k8s.io/type: presubmit",
+			expectWarning: true,
+		},
+		{
+			name: "prow configuration label",
+			job:  "labels:\n    prow.k8s.io/gerrit-report-label: Verified",
+		},
+		{
+			name: "prow annotation",
+			job:  "annotations:\n    prow.k8s.io/job: unit",
+		},
+		{
+			// The generator keeps the testgrid annotations set by the job.
+			name: "testgrid annotation",
+			job:  "annotations:\n    testgrid-dashboards: istio",
+		},
+		{
+			name:          "trigger label annotation",
+			job:           "annotations:\n    " + TriggerLabelAnnotation + ": ok-to-test",
+			expectWarning: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+jobs:
+- name: unit
+  image: fooimage:1.0
+  command: [make, test]
+  `+tt.job+"\n")
+			res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+			if (len(res.Warnings) != 0) != tt.expectWarning {
+				t.Errorf("expected warning %v, got %v", tt.expectWarning, res.Warnings)
+			}
+			for _, w := range res.Warnings {
+				if !strings.Contains(w.Error(), "job unit") {
+					t.Errorf("expected the warning to name the job, got %v", w)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRedundantRequirements(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		name             string
+		fileRequirements string
+		jobRequirements  string
+		expectWarning    bool
+	}{
+		{
+			name:             "no overlap",
+			fileRequirements: "[docker]",
+			jobRequirements:  "[github]",
+		},
+		{
+			name:            "job overlaps base",
+			jobRequirements: "[cache]",
+			expectWarning:   true,
+		},
+		{
+			name:             "job overlaps file",
+			fileRequirements: "[docker]",
+			jobRequirements:  "[docker]",
+			expectWarning:    true,
+		},
+		{
+			name:             "file overlaps base",
+			fileRequirements: "[cache]",
+			expectWarning:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+requirements: `+tt.fileRequirements+`
+jobs:
+- name: unit
+  command: [make, test]
+  requirements: `+tt.jobRequirements+"\n")
+			res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+			if (len(res.Warnings) != 0) != tt.expectWarning {
+				t.Errorf("expected warning %v, got %v", tt.expectWarning, res.Warnings)
+			}
+			if len(res.Errors) != 0 {
+				t.Errorf("expected no errors, got %v", res.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateOptionalRegex(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		name          string
+		job           string
+		expectWarning bool
+	}{
+		{
+			name: "optional",
+			job:  "modifiers: [presubmit_optional]",
+		},
+		{
+			name: "regex",
+			job:  "regex: '^docs/'",
+		},
+		{
+			name:          "optional and regex",
+			job:           "modifiers: [presubmit_optional]\n  regex: '^docs/'",
+			expectWarning: true,
+		},
+		{
+			name: "optional and regex postsubmit",
+			job:  "types: [postsubmit]\n  modifiers: [presubmit_optional]\n  regex: '^docs/'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+jobs:
+- name: unit
+  image: fooimage:1.0
+  command: [make, test]
+  `+tt.job+"\n")
+			res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+			if (len(res.Warnings) != 0) != tt.expectWarning {
+				t.Errorf("expected warning %v, got %v", tt.expectWarning, res.Warnings)
+			}
+		})
+	}
+}
+
+func TestValidateTimeout(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	cli := &Client{BaseConfig: bc}
+	tests := []struct {
+		name       string
+		timeout    string
+		maxTimeout *prowjob.Duration
+		expectErr  string
+	}{
+		{
+			name:    "valid",
+			timeout: "2h",
+		},
+		{
+			name:      "zero",
+			timeout:   "0s",
+			expectErr: "timeout 0s must be positive for job unit",
+		},
+		{
+			name:      "over default max",
+			timeout:   "720h",
+			expectErr: "timeout 720h0m0s of job unit exceeds the maximum of 24h0m0s",
+		},
+		{
+			name:       "over configured max",
+			timeout:    "2h",
+			maxTimeout: &prowjob.Duration{Duration: time.Hour},
+			expectErr:  "timeout 2h0m0s of job unit exceeds the maximum of 1h0m0s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli.BaseConfig.MaxTimeout = tt.maxTimeout
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+jobs:
+- name: unit
+  image: fooimage:1.0
+  command: [make, test]
+  timeout: `+tt.timeout+"\n")
+			res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+			if tt.expectErr == "" {
+				if len(res.Errors) != 0 {
+					t.Fatalf("expected no errors, got %v", res.Errors)
+				}
+				return
+			}
+			if len(res.Errors) != 1 || !strings.Contains(res.Errors[0].Error(), tt.expectErr) {
+				t.Errorf("expected error %q, got %v", tt.expectErr, res.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateMatrixExpansion(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		name      string
+		job       string
+		expectErr string
+	}{
+		{
+			name: "expanded",
+			job:  "e2e-$(matrix.mode)",
+		},
+		{
+			name:      "nested reference",
+			job:       "e2e-$(matrix.target)",
+			expectErr: `$(matrix.mode) is left unexpanded, it is referenced by the value "kind-$(matrix.mode)" of dimension "target"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+matrix:
+  mode: [ipv4, ipv6]
+  target: [kind-$(matrix.mode)]
+jobs:
+- name: `+tt.job+`
+  command: [make, test]
+`)
+			res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+			if tt.expectErr == "" {
+				if len(res.Errors) != 0 {
+					t.Fatalf("expected no errors, got %v", res.Errors)
+				}
+				return
+			}
+			if len(res.Errors) != 1 || !strings.Contains(res.Errors[0].Error(), tt.expectErr) {
+				t.Errorf("expected error %q, got %v", tt.expectErr, res.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateLocalResources(t *testing.T) {
+	bc := ReadBase(nil, "testdata/.base.yaml")
+	cli := &Client{BaseConfig: bc}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+resources_presets:
+  large:
+    requests:
+      cpu: 8
+jobs:
+- name: local
+  command: [make, test]
+  resources: large
+- name: global
+  command: [make, test]
+  resources: default
+`)
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) != 0 {
+		t.Fatalf("expected no errors without local resources, got %v", res.Errors)
+	}
+	cli.LocalResources = true
+	res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+	if len(res.Errors) != 1 || !strings.Contains(res.Errors[0].Error(), "job global references resources default") {
+		t.Errorf("expected an error for the global fallback of job global, got %v", res.Errors)
+	}
+}
+
+func TestValidateExcludedRequirements(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		// cache is a requirement of the base config.
+		"[cache]": false,
+		"[kind]":  true,
+		"[]":      false,
+	}
+	for excluded, expectWarning := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  excluded_requirements: `+excluded+"\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if len(res.Errors) != 0 {
+			t.Errorf("%s: expected no errors, got %v", excluded, res.Errors)
+		}
+		want := "excluded requirement kind of job unit is not one of its requirements"
+		if got := len(res.Warnings) != 0 && strings.Contains(res.Warnings[0].Error(), want); got != expectWarning {
+			t.Errorf("%s: expected warning %v, got %v", excluded, expectWarning, res.Warnings)
+		}
+	}
+}
+
+func TestValidateActiveDeadlineSeconds(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		fields        string
+		expectError   bool
+		expectWarning bool
+	}{
+		{fields: "active_deadline_seconds: 3600"},
+		{fields: "active_deadline_seconds: 7200\n  timeout: 2h"},
+		{fields: "active_deadline_seconds: 0", expectError: true},
+		{fields: "active_deadline_seconds: -1", expectError: true},
+		{fields: "active_deadline_seconds: 3600\n  timeout: 2h", expectWarning: true},
+	}
+	for _, tc := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  `+tc.fields+"\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if (len(res.Errors) != 0) != tc.expectError {
+			t.Errorf("%q: expected error %v, got %v", tc.fields, tc.expectError, res.Errors)
+		}
+		if (len(res.Warnings) != 0) != tc.expectWarning {
+			t.Errorf("%q: expected warning %v, got %v", tc.fields, tc.expectWarning, res.Warnings)
+		}
+	}
+}
+
+func TestValidateCloneURI(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"https://github.com/istio/istio.git": false,
+		"ssh://git@github.com/istio/istio":   false,
+		"git@github.com:istio/istio.git":     false,
+		"github.com/istio/istio":             true,
+		"https://github.com/istio/ istio":    true,
+	}
+	for uri, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  clone_uri: "`+uri+`"
+`)
+		if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", uri, expectError, res.Errors)
+		}
+	}
+}
+
+func TestValidateDashboardGroup(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		fields        string
+		expectError   bool
+		expectWarning bool
+	}{
+		{fields: "dashboard_group: istio_release-1.2"},
+		{fields: "dashboard_group: istio perf", expectError: true},
+		{fields: "dashboard_group: istio/perf", expectError: true},
+		{fields: "dashboard_group: istio\n  types: [presubmit]", expectWarning: true},
+	}
+	for _, tc := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  command: [make, test]
+  `+tc.fields+"\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if (len(res.Errors) != 0) != tc.expectError {
+			t.Errorf("%q: expected error %v, got %v", tc.fields, tc.expectError, res.Errors)
+		}
+		if (len(res.Warnings) != 0) != tc.expectWarning {
+			t.Errorf("%q: expected warning %v, got %v", tc.fields, tc.expectWarning, res.Warnings)
+		}
+	}
+}
+
+func TestValidateScheduleWithoutPeriodic(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := []struct {
+		file, job     string
+		expectWarning bool
+	}{
+		{job: "types: [presubmit]\n  cron: '0 4 * * *'", expectWarning: true},
+		{job: "interval: 24h", expectWarning: true},
+		{job: "types: [presubmit, periodic]\n  cron: '0 4 * * *'"},
+		{job: "types: [presubmit]"},
+		// The schedule of the file is meant for its periodics.
+		{file: "interval: 24h", job: "types: [presubmit]"},
+		{file: "interval: 24h", job: "types: [presubmit]\n  cron: '0 4 * * *'", expectWarning: true},
+	}
+	for _, tc := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+`+tc.file+`
+jobs:
+- name: unit
+  command: [make, test]
+  `+tc.job+"\n")
+		res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+		if len(res.Errors) != 0 {
+			t.Errorf("%q %q: expected no errors, got %v", tc.file, tc.job, res.Errors)
+		}
+		want := "the schedule of job unit is ignored, since it is not of type periodic"
+		if got := len(res.Warnings) != 0 && strings.Contains(res.Warnings[0].Error(), want); got != tc.expectWarning {
+			t.Errorf("%q %q: expected warning %v, got %v", tc.file, tc.job, tc.expectWarning, res.Warnings)
+		}
+	}
+}
+
+func TestValidateOptionalBranches(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	tests := map[string]bool{
+		"types: [presubmit]":                           false,
+		"types: [postsubmit]":                          true,
+		"optional: true":                               true,
+		"modifiers: [presubmit_optional]":              true,
+		"before_merge: true\n  types: [presubmit]":     true,
+		"trigger_label: preview\n  types: [presubmit]": true,
+	}
+	for fields, expectError := range tests {
+		jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: integ
+  command: [make, integ]
+  optional_branches: [feature/.*]
+  `+fields+"\n")
+		if res := cli.ValidateJobsConfig("jobs.yaml", jobs); (len(res.Errors) != 0) != expectError {
+			t.Errorf("%q: expected error %v, got %v", fields, expectError, res.Errors)
+		}
+	}
+
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: integ
+  command: [make, integ]
+  optional_branches: ["feature/("]
+`)
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) == 0 {
+		t.Error("expected an error for an invalid optional branch, but did not receive one")
+	}
+}
+
+func TestValidateUseImageEntrypoint(t *testing.T) {
+	cli := &Client{BaseConfig: ReadBase(nil, "testdata/.base.yaml")}
+	jobs := readJobsConfig(t, cli, `org: istio
+repo: istio
+image: fooimage:1.0
+jobs:
+- name: unit
+  use_image_entrypoint: true
+`)
+	res := cli.ValidateJobsConfig("jobs.yaml", jobs)
+	if len(res.Errors) != 1 || !strings.Contains(res.Errors[0].Error(), "use_image_entrypoint requires args for job unit") {
+		t.Errorf("expected an error for the job without args, got %v", res.Errors)
+	}
+
+	jobs.Jobs[0].Args = []string{"--verbose"}
+	if res := cli.ValidateJobsConfig("jobs.yaml", jobs); len(res.Errors) != 0 {
+		t.Errorf("expected no errors for the job with args, got %v", res.Errors)
+	}
+	output, err := cli.ConvertJobConfig("jobs.yaml", jobs, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateGeneratedConfig(output); err != nil {
+		t.Errorf("expected the generated config to be valid, got %v", err)
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	tests := map[string]string{
+		"fooimage":                          "fooimage",
+		"fooimage:1.0":                      "fooimage",
+		"localhost:5000/fooimage":           "localhost:5000/fooimage",
+		"localhost:5000/fooimage:1.0":       "localhost:5000/fooimage",
+		"gcr.io/istio/fooimage@sha256:abcd": "gcr.io/istio/fooimage",
+	}
+	for image, want := range tests {
+		if got := imageRepository(image); got != want {
+			t.Errorf("imageRepository(%q): expected %q, got %q", image, want, got)
+		}
+	}
+}